@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// baseURL is the scheme, host and any path prefix that clients reach us at,
+// without a trailing slash.  The configured BaseURL wins; otherwise it comes
+// from the request, honouring the Forwarded and X-Forwarded-* headers set
+// by a proxy if TrustForwarded is on.
+func (cfg *Config) baseURL(r *http.Request) string {
+	if cfg.BaseURL != "" {
+		return strings.TrimRight(cfg.BaseURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	prefix := ""
+
+	if cfg.TrustForwarded {
+		if proto := firstValue(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+			scheme = proto
+		}
+		if h := firstValue(r.Header.Get("X-Forwarded-Host")); h != "" {
+			host = h
+		}
+		// Forwarded is the standard version of the above, so it wins.
+		fwd := parseForwarded(r.Header.Get("Forwarded"))
+		if proto := fwd["proto"]; proto != "" {
+			scheme = proto
+		}
+		if h := fwd["host"]; h != "" {
+			host = h
+		}
+		prefix = firstValue(r.Header.Get("X-Forwarded-Prefix"))
+	}
+
+	scheme = strings.ToLower(scheme)
+	if scheme != "http" && scheme != "https" {
+		scheme = "http"
+	}
+	if !validHost(host) {
+		host = r.Host
+	}
+	return scheme + "://" + host + cleanPrefix(prefix)
+}
+
+// firstValue is the first of a comma separated header, which is the one
+// added by the proxy closest to the client.
+func firstValue(header string) string {
+	return strings.TrimSpace(strings.SplitN(header, ",", 2)[0])
+}
+
+// parseForwarded returns the parameters of the first element of an RFC 7239
+// Forwarded header, with lowercased names and unquoted values.
+func parseForwarded(header string) map[string]string {
+	params := map[string]string{}
+	first := strings.SplitN(header, ",", 2)[0]
+	for _, pair := range strings.Split(first, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+// validHost guards against headers that would let a client break out of
+// the authority, since the result ends up in responses and cached info.
+func validHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, "/\\?#@ \t\r\n\"<>")
+}
+
+// cleanPrefix turns "", "/", "iiif/" or "/iiif" into "" or "/iiif".
+func cleanPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" || strings.ContainsAny(prefix, "?#\\ \t\r\n\"<>") {
+		return ""
+	}
+	return "/" + prefix
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBaseURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		configured string
+		trust      bool
+		headers    map[string]string
+		expected   string
+	}{
+		{"", false, nil, "http://example.com"},
+		{"https://iiif.example.org/", false, nil, "https://iiif.example.org"},
+		{"https://iiif.example.org/iiif", true,
+			map[string]string{"X-Forwarded-Host": "evil.com"}, "https://iiif.example.org/iiif"},
+		// Forwarded headers are ignored unless trusted.
+		{"", false, map[string]string{
+			"X-Forwarded-Proto": "https", "X-Forwarded-Host": "public.org"},
+			"http://example.com"},
+		{"", true, map[string]string{
+			"X-Forwarded-Proto":  "https",
+			"X-Forwarded-Host":   "public.org, internal.lan",
+			"X-Forwarded-Prefix": "/images/"},
+			"https://public.org/images"},
+		{"", true, map[string]string{
+			"Forwarded":         `for=1.2.3.4;proto=https;host="std.org", for=5.6.7.8`,
+			"X-Forwarded-Host":  "legacy.org",
+			"X-Forwarded-Proto": "http"},
+			"https://std.org"},
+		{"", true, map[string]string{
+			"X-Forwarded-Proto": "javascript", "X-Forwarded-Host": "a.org/b"},
+			"http://example.com"},
+	}
+
+	for _, test := range tests {
+		cfg := &Config{BaseURL: test.configured, TrustForwarded: test.trust}
+		req := httptest.NewRequest("GET", "/sample2/info.json", nil)
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		if got := cfg.baseURL(req); got != test.expected {
+			t.Errorf("expected %s for %q %v, got: %s",
+				test.expected, test.configured, test.headers, got)
+		}
+	}
+}
+
+func TestBaseURLInResponses(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{{
+		Prefix:   "scans",
+		Resolver: ResolverConfig{Root: "images"},
+		Cache:    CachePolicy{Disabled: true},
+	}})
+	ctx.config.Load().TrustForwarded = true
+	router := newRouter(ctx)
+
+	forwarded := func(path string) *http.Request {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "iiif.example.org")
+		req.Header.Set("X-Forwarded-Prefix", "/iiif")
+		return req
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, forwarded("/scans/sample2/info.json"))
+	var info ImageInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Unexpected error decoding info.json: %s", err)
+	}
+	if info.ID != "https://iiif.example.org/iiif/scans/sample2" {
+		t.Errorf("unexpected @id: %s", info.ID)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, forwarded("/scans/sample2/full/50,/0/default.png"))
+	canonical := `<https://iiif.example.org/iiif/scans/sample2/full/50,/0/default.png>;rel="canonical"`
+	if !contains(w.Header()["Link"], canonical) {
+		t.Errorf("expected Link %s, got: %v", canonical, w.Header()["Link"])
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, forwarded("/scans/sample2"))
+	if loc := w.Header().Get("Location"); loc != "https://iiif.example.org/iiif/scans/sample2/info.json" {
+		t.Errorf("unexpected redirect: %s", loc)
+	}
+}
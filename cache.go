@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Cache holds rendered responses by key.  Keys are md5 hex strings, so
+// they're safe to use as file names.
+type Cache interface {
+	// Open returns the entry for key if there's one that hasn't expired and
+	// was rendered from the version of the source in tag.  Entries for
+	// other versions are removed.  The caller closes it.
+	Open(key string, tag CacheTag) (CachedEntry, bool)
+	// Create starts an entry for key, which nobody sees until it's
+	// committed.
+	Create(key string, tag CacheTag) (CacheWriter, error)
+	Delete(key string)
+	// Purge removes the entries rendered from the image id, or with prefix
+	// set from any image under id, by whole path segments, and says how
+	// many there were.
+	Purge(id string, prefix bool) int
+}
+
+// CachedEntry is an open cache entry, ready for http.ServeContent.
+type CachedEntry interface {
+	io.ReadSeeker
+	io.Closer
+	Size() int64
+}
+
+// CacheWriter writes a new cache entry.  Exactly one of Commit or Abort
+// must be called; Abort throws away whatever was written, e.g. when a
+// render fails halfway.
+type CacheWriter interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+// CacheTag says what a cache entry was rendered from.
+type CacheTag struct {
+	// ID is the image's path without the leading slash, e.g.
+	// scans/ms-12/f1r for identifier ms-12/f1r in the scans collection.
+	ID string `json:"id"`
+	// Version changes whenever the source image does.
+	Version string `json:"version"`
+}
+
+// sourceTag is the CacheTag for renders of src served under prefix.
+func sourceTag(prefix string, src *Source) CacheTag {
+	return CacheTag{
+		ID:      strings.TrimPrefix(iiifPath(prefix, src.Identifier), "/"),
+		Version: fmt.Sprintf("%d-%d", src.ModTime.UnixNano(), src.Size),
+	}
+}
+
+// renderTag is the CacheTag for renders of src served under prefix by
+// processor.  Processors don't write the same bytes for the same request, so
+// renders by another one are misses too.
+func renderTag(prefix string, src *Source, processor Processor) CacheTag {
+	tag := sourceTag(prefix, src)
+	tag.Version += "-" + processor.Name()
+	return tag
+}
+
+func (tag CacheTag) matches(id string, prefix bool) bool {
+	if prefix {
+		return underPrefix(tag.ID, id)
+	}
+	return tag.ID == id
+}
+
+// underPrefix says if id is prefix or somewhere under it, matching whole
+// path segments, so scans/ms-1 takes in scans/ms-1/f1r but not
+// scans/ms-12/f1r.
+func underPrefix(id, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || id == prefix || strings.HasPrefix(id, prefix+"/")
+}
+
+// tempPrefix marks files a DiskCache is still writing.  Any found when
+// rebuilding the index were left by a crash and are removed.
+const tempPrefix = ".tmp-"
+
+// maxHeaderSize bounds the line of JSON at the start of each DiskCache file
+// holding its CacheTag.
+const maxHeaderSize = 4096
+
+// ErrBadCacheKey .
+const ErrBadCacheKey = "Cache keys can't be empty or contain path separators"
+
+// ErrBadCacheHeader .
+const ErrBadCacheHeader = "Cached file has no valid header"
+
+// cacheEntry is an item in an LRU list, most recently used at the front.
+type cacheEntry struct {
+	key     string
+	tag     CacheTag
+	size    int64
+	written time.Time
+	data    []byte // MemoryCache only
+}
+
+// lru is the bookkeeping shared by DiskCache and MemoryCache.  It isn't safe
+// for concurrent use on its own.
+type lru struct {
+	maxBytes int64
+	maxAge   time.Duration
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newLRU(maxBytes int64, maxAge time.Duration) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get finds key's entry and marks it used.  Entries that have expired or
+// are for another version of the source are removed and returned in stale
+// so the caller can clean up after them.
+func (l *lru) get(key, version string, now time.Time) (entry *cacheEntry, stale *cacheEntry) {
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry = elem.Value.(*cacheEntry)
+	if (l.maxAge > 0 && now.Sub(entry.written) > l.maxAge) || entry.tag.Version != version {
+		l.remove(elem)
+		return nil, entry
+	}
+	l.order.MoveToFront(elem)
+	return entry, nil
+}
+
+// add puts entry at the front, replacing any entry with the same key, and
+// returns whatever had to be evicted to stay under maxBytes.
+func (l *lru) add(entry *cacheEntry) []*cacheEntry {
+	if elem, ok := l.entries[entry.key]; ok {
+		l.remove(elem)
+	}
+	l.entries[entry.key] = l.order.PushFront(entry)
+	l.size += entry.size
+	return l.evict()
+}
+
+// addOldest is add for an entry we know less recently used than everything
+// already there, for rebuilding an index oldest last.
+func (l *lru) addOldest(entry *cacheEntry) {
+	l.entries[entry.key] = l.order.PushBack(entry)
+	l.size += entry.size
+}
+
+func (l *lru) evict() []*cacheEntry {
+	var evicted []*cacheEntry
+	for l.maxBytes > 0 && l.size > l.maxBytes {
+		elem := l.order.Back()
+		if elem == nil {
+			break
+		}
+		evicted = append(evicted, elem.Value.(*cacheEntry))
+		l.remove(elem)
+	}
+	return evicted
+}
+
+func (l *lru) delete(key string) *cacheEntry {
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil
+	}
+	l.remove(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+func (l *lru) purge(id string, prefix bool) []*cacheEntry {
+	var purged []*cacheEntry
+	for _, elem := range l.entries {
+		entry := elem.Value.(*cacheEntry)
+		if entry.tag.matches(id, prefix) {
+			purged = append(purged, entry)
+			l.remove(elem)
+		}
+	}
+	return purged
+}
+
+func (l *lru) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	l.order.Remove(elem)
+	delete(l.entries, entry.key)
+	l.size -= entry.size
+}
+
+// DiskCache keeps entries as files in a directory, one per key, evicting
+// the least recently used once they add up to more than maxBytes and
+// treating anything older than maxAge as gone.  Zero means no limit for
+// either.
+//
+// Each file starts with a line of JSON holding the entry's CacheTag.  The
+// index of what's there is kept in memory and rebuilt from the directory on
+// startup, using modification times for age and, since that's all we have,
+// for recency.
+type DiskCache struct {
+	dir       string
+	evictions int64 // atomic
+
+	mu    sync.Mutex
+	index *lru
+}
+
+// NewDiskCache opens, or creates, the cache in dir.
+func NewDiskCache(dir string, maxBytes int64, maxAge time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{dir: dir, index: newLRU(maxBytes, maxAge)}
+	if err := c.rebuildIndex(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *DiskCache) rebuildIndex() error {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var entries []*cacheEntry
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		expired := c.index.maxAge > 0 && now.Sub(info.ModTime()) > c.index.maxAge
+		if expired || strings.HasPrefix(info.Name(), tempPrefix) {
+			os.Remove(filepath.Join(c.dir, info.Name()))
+			continue
+		}
+		tag, err := c.readTag(info.Name())
+		if err != nil {
+			// Probably from before entries were tagged; we can't tell
+			// when it's stale, so it has to go.
+			logrus.Warnf("removing cached file %s: %s", info.Name(), err)
+			os.Remove(filepath.Join(c.dir, info.Name()))
+			continue
+		}
+		entries = append(entries, &cacheEntry{
+			key:     info.Name(),
+			tag:     tag,
+			size:    info.Size(),
+			written: info.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].written.After(entries[j].written)
+	})
+
+	c.mu.Lock()
+	for _, entry := range entries {
+		c.index.addOldest(entry)
+	}
+	evicted := c.index.evict()
+	c.mu.Unlock()
+	c.removeFiles(evicted)
+
+	logrus.Infof("Cache has %d entries, %d bytes", len(entries)-len(evicted), c.Size())
+	return nil
+}
+
+// readTag reads the header of the file for key.
+func (c *DiskCache) readTag(key string) (CacheTag, error) {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return CacheTag{}, err
+	}
+	defer f.Close()
+	tag, _, err := splitHeader(bufio.NewReaderSize(f, maxHeaderSize))
+	return tag, err
+}
+
+// splitHeader reads the CacheTag off the front of r, leaving r at the
+// start of the cached data.  It also returns the header's length.
+func splitHeader(r *bufio.Reader) (CacheTag, int, error) {
+	var tag CacheTag
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return tag, 0, errors.New(ErrBadCacheHeader)
+	}
+	if err := json.Unmarshal(line, &tag); err != nil || tag.ID == "" {
+		return tag, 0, errors.New(ErrBadCacheHeader)
+	}
+	return tag, len(line), nil
+}
+
+// Open .
+func (c *DiskCache) Open(key string, tag CacheTag) (CachedEntry, bool) {
+	c.mu.Lock()
+	entry, stale := c.index.get(key, tag.Version, time.Now())
+	c.mu.Unlock()
+	if stale != nil {
+		c.removeFiles([]*cacheEntry{stale})
+	}
+	if entry == nil {
+		return nil, false
+	}
+
+	// The file may have been evicted, or replaced by a render of another
+	// version, since we let go of the lock.  Either's just a miss.
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Errorf("err opening cached file: %s", err)
+		}
+		return nil, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		logrus.Errorf("err opening cached file: %s", err)
+		return nil, false
+	}
+	fileTag, n, err := splitHeader(bufio.NewReaderSize(f, maxHeaderSize))
+	if err != nil || fileTag.Version != tag.Version {
+		f.Close()
+		return nil, false
+	}
+	return diskEntry{
+		SectionReader: io.NewSectionReader(f, int64(n), info.Size()-int64(n)),
+		f:             f,
+	}, true
+}
+
+// diskEntry is the part of a cached file after its header.
+type diskEntry struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (e diskEntry) Close() error {
+	return e.f.Close()
+}
+
+// Create writes to a temp file that Commit renames into place, so readers
+// never see a partial entry.
+func (c *DiskCache) Create(key string, tag CacheTag) (CacheWriter, error) {
+	if !validCacheKey(key) {
+		return nil, errors.New(ErrBadCacheKey)
+	}
+	header, err := json.Marshal(tag)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, '\n')
+	if len(header) > maxHeaderSize {
+		return nil, fmt.Errorf("cache tag for %s is too long", tag.ID)
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	cw := &diskWriter{cache: c, key: key, tag: tag, f: tmp}
+	if _, err := cw.Write(header); err != nil {
+		cw.Abort()
+		return nil, err
+	}
+	return cw, nil
+}
+
+type diskWriter struct {
+	cache *DiskCache
+	key   string
+	tag   CacheTag
+	f     *os.File
+	size  int64
+}
+
+func (cw *diskWriter) Write(p []byte) (int, error) {
+	n, err := cw.f.Write(p)
+	cw.size += int64(n)
+	return n, err
+}
+
+func (cw *diskWriter) Commit() error {
+	err := cw.f.Close()
+	if err == nil {
+		err = os.Chmod(cw.f.Name(), os.FileMode(0644))
+	}
+	if err == nil {
+		err = os.Rename(cw.f.Name(), cw.cache.path(cw.key))
+	}
+	if err != nil {
+		os.Remove(cw.f.Name())
+		return err
+	}
+
+	c := cw.cache
+	c.mu.Lock()
+	evicted := c.index.add(&cacheEntry{
+		key:     cw.key,
+		tag:     cw.tag,
+		size:    cw.size,
+		written: time.Now(),
+	})
+	c.mu.Unlock()
+	atomic.AddInt64(&c.evictions, int64(len(evicted)))
+	c.removeFiles(evicted)
+	return nil
+}
+
+func (cw *diskWriter) Abort() {
+	cw.f.Close()
+	os.Remove(cw.f.Name())
+}
+
+// Delete .
+func (c *DiskCache) Delete(key string) {
+	c.mu.Lock()
+	entry := c.index.delete(key)
+	c.mu.Unlock()
+	if entry != nil {
+		c.removeFiles([]*cacheEntry{entry})
+	}
+}
+
+// Purge .
+func (c *DiskCache) Purge(id string, prefix bool) int {
+	c.mu.Lock()
+	purged := c.index.purge(id, prefix)
+	c.mu.Unlock()
+	c.removeFiles(purged)
+	return len(purged)
+}
+
+// Size is the total size of the entries, in bytes.
+func (c *DiskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.index.size
+}
+
+// Len is the number of entries.
+func (c *DiskCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.index.order.Len()
+}
+
+// Evictions is how many entries have been pushed out to make room since
+// the cache was opened.
+func (c *DiskCache) Evictions() int64 {
+	return atomic.LoadInt64(&c.evictions)
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// removeFiles deletes entries that have already left the index.  A Put
+// racing with this for the same key can lose its file, which costs a
+// render later but is otherwise harmless.
+func (c *DiskCache) removeFiles(entries []*cacheEntry) {
+	for _, entry := range entries {
+		err := os.Remove(c.path(entry.key))
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("err removing cached file: %s", err)
+		}
+	}
+}
+
+func validCacheKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, `/\`) &&
+		!strings.HasPrefix(key, tempPrefix) && key != "." && key != ".."
+}
+
+// MemoryCache is a Cache that never touches the disk.  It's the front tier
+// of a TieredCache, and a stand-in for the DiskCache in tests.
+type MemoryCache struct {
+	evictions int64 // atomic
+
+	mu    sync.Mutex
+	index *lru
+}
+
+// NewMemoryCache .
+func NewMemoryCache(maxBytes int64, maxAge time.Duration) *MemoryCache {
+	return &MemoryCache{index: newLRU(maxBytes, maxAge)}
+}
+
+// Open .
+func (c *MemoryCache) Open(key string, tag CacheTag) (CachedEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, _ := c.index.get(key, tag.Version, time.Now())
+	if entry == nil {
+		return nil, false
+	}
+	return memoryEntry{bytes.NewReader(entry.data)}, true
+}
+
+type memoryEntry struct {
+	*bytes.Reader
+}
+
+func (memoryEntry) Close() error { return nil }
+
+// Create .
+func (c *MemoryCache) Create(key string, tag CacheTag) (CacheWriter, error) {
+	if !validCacheKey(key) {
+		return nil, errors.New(ErrBadCacheKey)
+	}
+	return &memoryWriter{cache: c, key: key, tag: tag}, nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	cache *MemoryCache
+	key   string
+	tag   CacheTag
+}
+
+func (cw *memoryWriter) Commit() error {
+	cw.cache.put(cw.key, cw.tag, cw.Bytes())
+	return nil
+}
+
+func (cw *memoryWriter) Abort() {}
+
+// put adds an entry.  Entries bigger than the whole cache are dropped
+// rather than emptying it to make room.
+func (c *MemoryCache) put(key string, tag CacheTag, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.fits(int64(len(data))) {
+		c.index.delete(key)
+		return
+	}
+	evicted := c.index.add(&cacheEntry{
+		key:     key,
+		tag:     tag,
+		size:    int64(len(data)),
+		written: time.Now(),
+		data:    data,
+	})
+	atomic.AddInt64(&c.evictions, int64(len(evicted)))
+}
+
+// fits reports whether an entry of size bytes can go in the cache at all.
+func (c *MemoryCache) fits(size int64) bool {
+	return c.index.maxBytes == 0 || size <= c.index.maxBytes
+}
+
+// Delete .
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index.delete(key)
+}
+
+// Purge .
+func (c *MemoryCache) Purge(id string, prefix bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.index.purge(id, prefix))
+}
+
+// Len is the number of entries.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.index.order.Len()
+}
+
+// Size is the total size of the entries, in bytes.
+func (c *MemoryCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.index.size
+}
+
+// Evictions is how many entries have been pushed out to make room.
+func (c *MemoryCache) Evictions() int64 {
+	return atomic.LoadInt64(&c.evictions)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTag's header is 25 bytes.
+var testTag = CacheTag{ID: "t", Version: "1"}
+
+func tempCacheDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "iiif-cache")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %s", err)
+	}
+	return dir
+}
+
+// cacheGet reads a whole entry.
+func cacheGet(c Cache, key string, tag CacheTag) ([]byte, bool) {
+	entry, ok := c.Open(key, tag)
+	if !ok {
+		return nil, false
+	}
+	defer entry.Close()
+	data, err := ioutil.ReadAll(entry)
+	return data, err == nil
+}
+
+// cachePut writes a whole entry.
+func cachePut(c Cache, key string, tag CacheTag, data []byte) error {
+	cw, err := c.Create(key, tag)
+	if err != nil {
+		return err
+	}
+	if _, err := cw.Write(data); err != nil {
+		cw.Abort()
+		return err
+	}
+	return cw.Commit()
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	t.Parallel()
+
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(dir, 75, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error opening cache: %s", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := cachePut(cache, key, testTag, bytes.Repeat([]byte(key), 10)); err != nil {
+			t.Fatalf("Unexpected error writing %s: %s", key, err)
+		}
+	}
+	// Using a makes b the one to go.
+	if _, ok := cacheGet(cache, "a", testTag); !ok {
+		t.Fatalf("expected a hit for a")
+	}
+	if err := cachePut(cache, "c", testTag, bytes.Repeat([]byte("c"), 10)); err != nil {
+		t.Fatalf("Unexpected error writing c: %s", err)
+	}
+
+	if _, ok := cacheGet(cache, "b", testTag); ok {
+		t.Errorf("expected b to be evicted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Errorf("expected b's file to be removed, got: %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		data, ok := cacheGet(cache, key, testTag)
+		if !ok || string(data) != string(bytes.Repeat([]byte(key), 10)) {
+			t.Errorf("expected %s to survive, got: %q %v", key, data, ok)
+		}
+	}
+	if cache.Size() != 70 {
+		t.Errorf("expected 70 bytes cached, got: %d", cache.Size())
+	}
+}
+
+func TestDiskCacheFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error opening cache: %s", err)
+	}
+	if err := cachePut(cache, "abc", testTag, []byte("rendered")); err != nil {
+		t.Fatalf("Unexpected error writing: %s", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "abc"))
+	if err != nil {
+		t.Fatalf("Unexpected error reading cached file: %s", err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("expected 0644, got: %s", info.Mode().Perm())
+	}
+
+	for _, key := range []string{"", "../abc", "a/b", tempPrefix + "x"} {
+		if err := cachePut(cache, key, testTag, []byte("x")); err == nil {
+			t.Errorf("expected an error for key %q", key)
+		}
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected only abc in the cache dir, got: %d files", len(entries))
+	}
+
+	cache.Delete("abc")
+	if _, ok := cacheGet(cache, "abc", testTag); ok {
+		t.Errorf("expected abc to be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "abc")); !os.IsNotExist(err) {
+		t.Errorf("expected abc's file to be removed, got: %v", err)
+	}
+}
+
+func TestDiskCacheRebuild(t *testing.T) {
+	t.Parallel()
+
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	write := func(name string, age time.Duration) {
+		path := filepath.Join(dir, name)
+		data := []byte(`{"id":"t","version":"1"}` + "\n0123456789")
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Unexpected error writing %s: %s", name, err)
+		}
+		when := time.Now().Add(-age)
+		if err := os.Chtimes(path, when, when); err != nil {
+			t.Fatalf("Unexpected error setting times on %s: %s", name, err)
+		}
+	}
+	write("fresh", time.Minute)
+	write("older", time.Hour)
+	write("oldest", 2*time.Hour)
+	write("stale", 48*time.Hour)
+	write(tempPrefix+"123", time.Minute)
+
+	cache, err := NewDiskCache(dir, 75, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error opening cache: %s", err)
+	}
+
+	if _, ok := cacheGet(cache, "fresh", testTag); !ok {
+		t.Errorf("expected fresh to be found after a restart")
+	}
+	if _, ok := cacheGet(cache, "older", testTag); !ok {
+		t.Errorf("expected older to be found after a restart")
+	}
+	// Over maxBytes, so the least recent goes.
+	if _, err := os.Stat(filepath.Join(dir, "oldest")); !os.IsNotExist(err) {
+		t.Errorf("expected oldest to be evicted, got: %v", err)
+	}
+	if _, ok := cacheGet(cache, "stale", testTag); ok {
+		t.Errorf("expected stale to have expired")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stale")); !os.IsNotExist(err) {
+		t.Errorf("expected stale's file to be removed, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tempPrefix+"123")); !os.IsNotExist(err) {
+		t.Errorf("expected leftover temp files to be removed, got: %v", err)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("expected 2 entries, got: %d", cache.Len())
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	t.Parallel()
+
+	cache := NewMemoryCache(15, time.Hour)
+	cachePut(cache, "a", testTag, []byte("0123456789"))
+	cachePut(cache, "b", testTag, []byte("0123456789"))
+	if _, ok := cacheGet(cache, "a", testTag); ok {
+		t.Errorf("expected a to be evicted")
+	}
+	if data, ok := cacheGet(cache, "b", testTag); !ok || string(data) != "0123456789" {
+		t.Errorf("expected b, got: %q %v", data, ok)
+	}
+	cache.Delete("b")
+	if cache.Len() != 0 {
+		t.Errorf("expected an empty cache, got: %d entries", cache.Len())
+	}
+}
+
+func TestDiskCacheVersions(t *testing.T) {
+	t.Parallel()
+
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error opening cache: %s", err)
+	}
+	old := CacheTag{ID: "scans/ms-1/f1r", Version: "1"}
+	cachePut(cache, "a", old, []byte("old scan"))
+	cachePut(cache, "b", CacheTag{ID: "scans/ms-1/f1v", Version: "1"}, []byte("x"))
+	cachePut(cache, "c", CacheTag{ID: "scans/ms-10/f1r", Version: "1"}, []byte("x"))
+	cachePut(cache, "d", CacheTag{ID: "maps/ms-1", Version: "1"}, []byte("x"))
+	cachePut(cache, "e", CacheTag{ID: "scans/ms-1/f2r", Version: "1"}, []byte("x"))
+	ioutil.WriteFile(filepath.Join(dir, "untagged"), []byte("from before tags"), 0644)
+
+	// Tags survive a restart, and anything untagged is dropped.
+	cache, err = NewDiskCache(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening cache: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "untagged")); !os.IsNotExist(err) {
+		t.Errorf("expected untagged files to be removed, got: %v", err)
+	}
+	if data, ok := cacheGet(cache, "a", old); !ok || string(data) != "old scan" {
+		t.Errorf("expected the old scan, got: %q %v", data, ok)
+	}
+
+	// A new version of the source is a miss, and the old render goes.
+	if _, ok := cacheGet(cache, "a", CacheTag{ID: old.ID, Version: "2"}); ok {
+		t.Errorf("expected a miss for a new version")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected the stale render to be removed, got: %v", err)
+	}
+
+	if n := cache.Purge("scans/ms-1/f1v", false); n != 1 {
+		t.Errorf("expected to purge 1 entry for the identifier, got: %d", n)
+	}
+	// Prefixes match whole segments, so ms-1 leaves ms-10 alone.
+	if n := cache.Purge("scans/ms-1", true); n != 1 {
+		t.Errorf("expected to purge 1 entry under scans/ms-1, got: %d", n)
+	}
+	if n := cache.Purge("scans/", true); n != 1 {
+		t.Errorf("expected to purge 1 entry for the prefix, got: %d", n)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("expected maps/ms-1 to be left, got: %d entries", cache.Len())
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected purged files to be removed, got: %d files", len(entries))
+	}
+}
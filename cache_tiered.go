@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// TieredCache keeps the hottest entries in memory in front of a bigger,
+// slower cache, usually a DiskCache.  Writes go to both tiers, or just the
+// slow one if they're too big for memory, so nothing is lost on a restart.
+// A hit in the slow tier promotes the entry to memory; entries the memory
+// tier evicts are demoted, which just means they're served from the slow
+// tier until they're hot again.
+type TieredCache struct {
+	stats CacheStats // atomic
+
+	memory *MemoryCache
+	slow   Cache
+}
+
+// CacheStats counts how a TieredCache has been doing since it started.
+type CacheStats struct {
+	MemoryHits   int64 `json:"memoryHits"`
+	MemoryMisses int64 `json:"memoryMisses"`
+	DiskHits     int64 `json:"diskHits"`
+	DiskMisses   int64 `json:"diskMisses"`
+	Promotions   int64 `json:"promotions"`
+	Demotions    int64 `json:"demotions"`
+}
+
+// NewTieredCache puts memory in front of slow.
+func NewTieredCache(memory *MemoryCache, slow Cache) *TieredCache {
+	return &TieredCache{memory: memory, slow: slow}
+}
+
+// Open .
+func (c *TieredCache) Open(key string, tag CacheTag) (CachedEntry, bool) {
+	if entry, ok := c.memory.Open(key, tag); ok {
+		atomic.AddInt64(&c.stats.MemoryHits, 1)
+		return entry, true
+	}
+	atomic.AddInt64(&c.stats.MemoryMisses, 1)
+
+	entry, ok := c.slow.Open(key, tag)
+	if !ok {
+		atomic.AddInt64(&c.stats.DiskMisses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&c.stats.DiskHits, 1)
+	if !c.memory.fits(entry.Size()) {
+		return entry, true
+	}
+
+	defer entry.Close()
+	data, err := ioutil.ReadAll(entry)
+	if err != nil {
+		logrus.Errorf("err promoting cache entry: %s", err)
+		return nil, false
+	}
+	atomic.AddInt64(&c.stats.Promotions, 1)
+	c.memory.put(key, tag, data)
+	return memoryEntry{bytes.NewReader(data)}, true
+}
+
+// Create writes to the slow tier, so the memory tier never has anything a
+// restart would lose, keeping a copy for memory as long as it would fit.
+func (c *TieredCache) Create(key string, tag CacheTag) (CacheWriter, error) {
+	slow, err := c.slow.Create(key, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &tieredWriter{cache: c, key: key, tag: tag, slow: slow, buf: new(bytes.Buffer)}, nil
+}
+
+type tieredWriter struct {
+	cache *TieredCache
+	key   string
+	tag   CacheTag
+	slow  CacheWriter
+	// buf is dropped once it's outgrown the memory tier.
+	buf *bytes.Buffer
+}
+
+func (cw *tieredWriter) Write(p []byte) (int, error) {
+	if cw.buf != nil {
+		if cw.cache.memory.fits(int64(cw.buf.Len() + len(p))) {
+			cw.buf.Write(p)
+		} else {
+			cw.buf = nil
+		}
+	}
+	return cw.slow.Write(p)
+}
+
+func (cw *tieredWriter) Commit() error {
+	if err := cw.slow.Commit(); err != nil {
+		return err
+	}
+	if cw.buf != nil {
+		cw.cache.memory.put(cw.key, cw.tag, cw.buf.Bytes())
+	}
+	return nil
+}
+
+func (cw *tieredWriter) Abort() {
+	cw.slow.Abort()
+}
+
+// Delete .
+func (c *TieredCache) Delete(key string) {
+	c.memory.Delete(key)
+	c.slow.Delete(key)
+}
+
+// Purge .
+func (c *TieredCache) Purge(id string, prefix bool) int {
+	c.memory.Purge(id, prefix)
+	return c.slow.Purge(id, prefix)
+}
+
+// Stats .
+func (c *TieredCache) Stats() CacheStats {
+	return CacheStats{
+		MemoryHits:   atomic.LoadInt64(&c.stats.MemoryHits),
+		MemoryMisses: atomic.LoadInt64(&c.stats.MemoryMisses),
+		DiskHits:     atomic.LoadInt64(&c.stats.DiskHits),
+		DiskMisses:   atomic.LoadInt64(&c.stats.DiskMisses),
+		Promotions:   atomic.LoadInt64(&c.stats.Promotions),
+		Demotions:    c.memory.Evictions(),
+	}
+}
+
+// cacheStatsHandler serves the cache's counters at /admin/cache, if it's
+// tiered.
+func cacheStatsHandler(ctx Context, w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(ctx.config.Load(), w, r) {
+		return
+	}
+	tiered, ok := ctx.cache.(*TieredCache)
+	if !ok {
+		writeError(w, r, notFound("", "the cache has no memory tier"))
+		return
+	}
+	out, err := json.MarshalIndent(tiered.Stats(), "", "  ")
+	if err != nil {
+		writeError(w, r, internalError(fmt.Errorf("err encoding cache stats: %s", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
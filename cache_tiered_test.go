@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTieredCache(t *testing.T) {
+	t.Parallel()
+
+	slow := NewMemoryCache(0, 0)
+	memory := NewMemoryCache(15, 0)
+	cache := NewTieredCache(memory, slow)
+
+	cachePut(cache, "a", testTag, []byte("0123456789"))
+	if memory.Len() != 1 || slow.Len() != 1 {
+		t.Fatalf("expected a in both tiers, got: %d in memory, %d in slow", memory.Len(), slow.Len())
+	}
+
+	// b pushes a out of memory, but it's still in the slow tier.
+	cachePut(cache, "b", testTag, []byte("0123456789"))
+	if _, ok := cacheGet(memory, "a", testTag); ok {
+		t.Errorf("expected a to be demoted")
+	}
+	if data, ok := cacheGet(cache, "a", testTag); !ok || string(data) != "0123456789" {
+		t.Fatalf("expected a from the slow tier, got: %q %v", data, ok)
+	}
+	// ...and is promoted back.
+	if _, ok := cacheGet(memory, "a", testTag); !ok {
+		t.Errorf("expected a to be promoted")
+	}
+	cacheGet(cache, "a", testTag)
+	if _, ok := cacheGet(cache, "missing", testTag); ok {
+		t.Errorf("expected a miss")
+	}
+
+	expected := CacheStats{
+		MemoryHits:   1,
+		MemoryMisses: 2,
+		DiskHits:     1,
+		DiskMisses:   1,
+		Promotions:   1,
+		Demotions:    2,
+	}
+	if stats := cache.Stats(); stats != expected {
+		t.Errorf("expected %+v, got: %+v", expected, stats)
+	}
+
+	cache.Delete("a")
+	if _, ok := cacheGet(slow, "a", testTag); ok {
+		t.Errorf("expected a to be deleted from both tiers")
+	}
+
+	// Too big for memory at all, but fine on disk.
+	cachePut(cache, "big", testTag, make([]byte, 100))
+	if _, ok := cacheGet(memory, "big", testTag); ok {
+		t.Errorf("expected big to skip the memory tier")
+	}
+	if _, ok := cacheGet(cache, "big", testTag); !ok {
+		t.Errorf("expected big from the slow tier")
+	}
+}
+
+func TestCacheStatsHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{{Resolver: ResolverConfig{Root: "images"}}})
+	ctx.cache = NewTieredCache(NewMemoryCache(1<<20, 0), NewMemoryCache(0, 0))
+	router := newRouter(ctx)
+
+	path := "/sample2/full/50,/0/default.png"
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got: %d", w.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/admin/cache", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var stats CacheStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Unexpected error decoding stats: %s", err)
+	}
+	if stats.MemoryHits != 2 || stats.DiskMisses != 1 {
+		t.Errorf("expected 2 memory hits and a miss, got: %+v", stats)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/cache", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 from outside the admin networks, got: %d", w.Code)
+	}
+}
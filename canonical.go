@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/url"
+	"strconv"
+)
+
+// canonicalPath is the IIIF canonical form of imgReq's URL path, given the
+// dimensions of the image it's for, so that equivalent requests (pct:100
+// and full, !w,h and w,) come out the same.  See
+// https://iiif.io/api/image/2.1/#canonical-uri-syntax and
+// https://iiif.io/api/image/3.0/#47-canonical-uri-syntax
+func (imgReq ImageReq) canonicalPath(stats WidthHeight) (string, error) {
+	region, out, err := imgReq.geometry(stats)
+	if err != nil {
+		return "", err
+	}
+	regionWH := WidthHeight{Width: region.Dx(), Height: region.Dy()}
+
+	var canonRegion string
+	if region == image.Rect(0, 0, stats.Width, stats.Height) {
+		canonRegion = "full"
+	} else {
+		canonRegion = fmt.Sprintf("%d,%d,%d,%d",
+			region.Min.X, region.Min.Y, region.Dx(), region.Dy())
+	}
+
+	var canonSize string
+	if imgReq.Version >= 3 {
+		_, isMax := imgReq.Size.(SizeMax)
+		switch {
+		case isMax && out == regionWH:
+			canonSize = "max"
+		case out.Width > regionWH.Width || out.Height > regionWH.Height:
+			canonSize = fmt.Sprintf("^%d,%d", out.Width, out.Height)
+		default:
+			canonSize = fmt.Sprintf("%d,%d", out.Width, out.Height)
+		}
+	} else {
+		// 2.1: full, w, if that gets the same height, otherwise w,h.
+		byWidth, err := scaledSize(SizeWidth{Width: out.Width}, regionWH)
+		switch {
+		case out == regionWH:
+			canonSize = "full"
+		case err == nil && byWidth == out:
+			canonSize = fmt.Sprintf("%d,", out.Width)
+		default:
+			canonSize = fmt.Sprintf("%d,%d", out.Width, out.Height)
+		}
+	}
+
+	var canonRotation string
+	switch rotation := imgReq.Rotation.(type) {
+	case RotateStandard:
+		canonRotation = formatDegrees(rotation.Degrees)
+	case RotateMirrored:
+		canonRotation = "!" + formatDegrees(rotation.Degrees)
+	default:
+		return "", fmt.Errorf("Unrecognized rotation: %v", imgReq.Rotation)
+	}
+
+	return fmt.Sprintf("%s/%s/%s/%s/%s.%s",
+		iiifPath(imgReq.Prefix, url.PathEscape(imgReq.Identifier)),
+		canonRegion,
+		canonSize,
+		canonRotation,
+		imgReq.Quality,
+		imgReq.Format,
+	), nil
+}
+
+// formatDegrees writes 90 rather than 90.000000, and 22.5 as is.
+func formatDegrees(degrees float64) string {
+	return strconv.FormatFloat(degrees, 'f', -1, 64)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanonicalPath(t *testing.T) {
+	t.Parallel()
+
+	stats := WidthHeight{300, 200}
+	tests := []struct {
+		region   string
+		size     string
+		rotation string
+		version  int
+		expected string
+	}{
+		{"full", "full", "0", 2, "/id/full/full/0/default.png"},
+		{"pct:0,0,100,100", "pct:100", "0", 2, "/id/full/full/0/default.png"},
+		{"0,0,300,200", "300,200", "0", 2, "/id/full/full/0/default.png"},
+		{"full", "!150,150", "0", 2, "/id/full/150,/0/default.png"},
+		{"full", ",100", "0", 2, "/id/full/150,/0/default.png"},
+		{"full", "150,150", "0", 2, "/id/full/150,150/0/default.png"},
+		{"full", "max", "0", 2, "/id/full/full/0/default.png"},
+		{"square", "full", "90.0", 2, "/id/50,0,200,200/full/90/default.png"},
+		{"pct:50,50,100,100", "full", "!22.50", 2, "/id/150,100,150,100/full/!22.5/default.png"},
+		{"full", "max", "0", 3, "/id/full/max/0/default.png"},
+		{"full", "full", "0", 3, "/id/full/300,200/0/default.png"},
+		{"full", "150,", "0", 3, "/id/full/150,100/0/default.png"},
+		{"full", "^600,", "0", 3, "/id/full/^600,400/0/default.png"},
+	}
+
+	for _, test := range tests {
+		region, err := parseRegion(test.region)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %s", test.region, err)
+		}
+		size, err := parseSize(trimCaret(test.size))
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %s", test.size, err)
+		}
+		rotation, err := parseRotation(test.rotation)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %s", test.rotation, err)
+		}
+		imgReq := ImageReq{
+			Identifier: "id",
+			Region:     region,
+			Size:       size,
+			Upscale:    test.size[0] == '^',
+			Rotation:   rotation,
+			Quality:    "default",
+			Format:     "png",
+			Version:    test.version,
+		}
+		got, err := imgReq.canonicalPath(stats)
+		if err != nil {
+			t.Errorf("Unexpected error for %s/%s: %s", test.region, test.size, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("expected %s for %s/%s/%s (v%d), got: %s",
+				test.expected, test.region, test.size, test.rotation, test.version, got)
+		}
+	}
+}
+
+func TestCanonicalRequests(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{{Resolver: ResolverConfig{Root: "images"}}})
+	router := newRouter(ctx)
+
+	for _, path := range []string{
+		"/sample2/pct:0,0,100,100/pct:50/0/default.png",
+		"/sample2/full/150,/0/default.png",
+		"/sample2/full/!150,150/0/default.png",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 for %s, got: %d", path, w.Code)
+		}
+		canonical := `<http://example.com/sample2/full/150,/0/default.png>;rel="canonical"`
+		if !contains(w.Header()["Link"], canonical) {
+			t.Errorf("expected Link %s for %s, got: %v", canonical, path, w.Header()["Link"])
+		}
+	}
+
+	if n := ctx.cache.(*MemoryCache).Len(); n != 1 {
+		t.Errorf("expected equivalent requests to share one cache entry, got: %d", n)
+	}
+
+	redirecting := testContext(t, []*Collection{{
+		Resolver: ResolverConfig{Root: "images"},
+		Cache:    CachePolicy{Disabled: true},
+	}})
+	redirecting.config.Load().RedirectToCanonical = true
+	router = newRouter(redirecting)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/sample2/full/!150,150/0/default.png", nil))
+	if w.Code != http.StatusSeeOther ||
+		w.Header().Get("Location") != "http://example.com/sample2/full/150,/0/default.png" {
+		t.Errorf("expected a 303 to the canonical URI, got: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/sample2/full/150,/0/default.png", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected canonical requests to be served, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// renderGroup collapses identical renders that are in flight at the same
+// time into one, so a burst of requests for a tile that isn't cached yet
+// costs a single convert.  Renders are keyed by their canonical request.
+// Only the request that started a render gets its output as it's made;
+// the others are told when it's done and read it from the cache.
+//
+// The shared render has its own context rather than the first client's,
+// and is only cancelled once every request waiting on it has gone away.
+type renderGroup struct {
+	mu    sync.Mutex
+	calls map[string]*renderCall
+}
+
+// renderCall is one in-flight render and the requests waiting on it.
+type renderCall struct {
+	done    chan struct{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newRenderGroup() *renderGroup {
+	return &renderGroup{calls: make(map[string]*renderCall)}
+}
+
+// Do runs render for key, unless the same key is already being rendered,
+// in which case it waits for that one, and returns its error.  render is
+// given timeout to finish.  If ctx ends first Do returns ctx.Err(), and if
+// it was the last one waiting the render is cancelled.  shared reports
+// whether it was another request's render.
+func (g *renderGroup) Do(
+	ctx context.Context,
+	key string,
+	timeout time.Duration,
+	render func(ctx context.Context) error,
+) (shared bool, err error) {
+	g.mu.Lock()
+	call, shared := g.calls[key]
+	if !shared {
+		renderCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		call = &renderCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go g.run(key, call, renderCtx, render)
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return shared, call.err
+	case <-ctx.Done():
+		g.leave(key, call)
+		return shared, ctx.Err()
+	}
+}
+
+func (g *renderGroup) run(
+	key string,
+	call *renderCall,
+	ctx context.Context,
+	render func(ctx context.Context) error,
+) {
+	err := render(ctx)
+	call.cancel()
+
+	g.mu.Lock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+
+	call.err = err
+	close(call.done)
+}
+
+// leave gives up on call for one waiter, cancelling it if nobody else is
+// left.  The call is forgotten straight away so a new request starts a
+// fresh render rather than joining a cancelled one.
+func (g *renderGroup) leave(key string, call *renderCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	call.cancel()
+}
+
+// InFlight is the number of distinct renders running or queued.
+func (g *renderGroup) InFlight() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.calls)
+}
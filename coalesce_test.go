@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRenderGroupSharesOneRender(t *testing.T) {
+	t.Parallel()
+
+	g := newRenderGroup()
+	var runs int32
+	release := make(chan struct{})
+	render := func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var sharedCount int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shared, err := g.Do(context.Background(), "k", time.Second, render)
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+		}()
+	}
+	// Let every waiter join before the render finishes.
+	for g.waiters("k") < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if runs != 1 || sharedCount != 9 {
+		t.Errorf("expected 1 render shared by 9 others, got: %d renders, %d shared", runs, sharedCount)
+	}
+	if g.InFlight() != 0 {
+		t.Errorf("expected nothing in flight, got: %d", g.InFlight())
+	}
+}
+
+func TestRenderGroupSharesErrors(t *testing.T) {
+	t.Parallel()
+
+	g := newRenderGroup()
+	_, err := g.Do(context.Background(), "k", time.Second, func(context.Context) error {
+		return errors.New("convert failed")
+	})
+	if err == nil || err.Error() != "convert failed" {
+		t.Errorf("expected the render's error, got: %v", err)
+	}
+}
+
+func TestRenderGroupCancellation(t *testing.T) {
+	t.Parallel()
+
+	g := newRenderGroup()
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	release := make(chan struct{})
+	render := func(ctx context.Context) error {
+		close(started)
+		select {
+		case <-ctx.Done():
+			close(cancelled)
+			return ctx.Err()
+		case <-release:
+			return nil
+		}
+	}
+
+	// One of two waiters going away leaves the render running for the other.
+	leaving, leave := context.WithCancel(context.Background())
+	staying, stay := context.WithCancel(context.Background())
+	results := make(chan error, 2)
+	go func() {
+		_, err := g.Do(leaving, "k", time.Second, render)
+		results <- err
+	}()
+	<-started
+	go func() {
+		_, err := g.Do(staying, "k", time.Second, render)
+		results <- err
+	}()
+	for g.waiters("k") < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	leave()
+	if err := <-results; err != context.Canceled {
+		t.Errorf("expected the leaving waiter to see Canceled, got: %v", err)
+	}
+	select {
+	case <-cancelled:
+		t.Fatalf("expected the render to survive one waiter leaving")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The last one going away cancels it.
+	stay()
+	if err := <-results; err != context.Canceled {
+		t.Errorf("expected the staying waiter to see Canceled, got: %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("expected the render to be cancelled once nobody was waiting")
+	}
+	if g.InFlight() != 0 {
+		t.Errorf("expected the cancelled render to be forgotten, got: %d in flight", g.InFlight())
+	}
+}
+
+func TestRenderGroupTimeout(t *testing.T) {
+	t.Parallel()
+
+	g := newRenderGroup()
+	_, err := g.Do(context.Background(), "k", 10*time.Millisecond,
+		func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got: %v", err)
+	}
+}
+
+// waiters is how many requests are waiting on key, for tests.
+func (g *renderGroup) waiters(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call.waiters
+	}
+	return 0
+}
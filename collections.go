@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Collection is the configuration for every image under one URL prefix.
+type Collection struct {
+	// Prefix is the first path segment, or "" for the prefix-less form
+	// (/{identifier}/...).
+	Prefix   string         `yaml:"prefix" json:"prefix"`
+	Resolver ResolverConfig `yaml:"resolver" json:"resolver"`
+	// Version is the IIIF Image API major version served, 2 (the default)
+	// or 3.  Clients can still ask for either info.json shape with Accept.
+	Version int `yaml:"version" json:"version"`
+	// Formats limits the output formats offered; empty means all of them.
+	Formats []string `yaml:"formats" json:"formats"`
+	// TileSize is the tile width and height advertised in info.json.
+	TileSize   int `yaml:"tileSize" json:"tileSize"`
+	SizeLimits `yaml:",inline"`
+	Cache      CachePolicy `yaml:"cache" json:"cache"`
+	Access     AccessRules `yaml:"access" json:"access"`
+
+	resolver Resolver
+}
+
+// CachePolicy controls whether renders for a collection are cached, and
+// how long clients may cache them.
+type CachePolicy struct {
+	Disabled bool `yaml:"disabled" json:"disabled"`
+	// CacheControl is sent with image and info.json responses, e.g.
+	// "public, max-age=31536000, immutable".  Defaults to a day, private
+	// if the collection has access rules.
+	CacheControl string `yaml:"cacheControl" json:"cacheControl,omitempty"`
+}
+
+// AccessRules restrict who can see a collection.  If Networks is set the
+// client must be in one of them; if Tokens is set it must send one of them
+// as "Authorization: Bearer <token>".
+type AccessRules struct {
+	Networks []string `yaml:"networks" json:"networks"`
+	Tokens   []string `yaml:"tokens" json:"-"`
+
+	networks []*net.IPNet
+}
+
+// Collections maps URL prefixes to their configuration.
+type Collections struct {
+	byPrefix map[string]*Collection
+	// fallback serves every prefix when no collections are configured, which
+	// is how the server behaved before collections existed.
+	fallback *Collection
+}
+
+func newCollections(colls []*Collection) (*Collections, error) {
+	c := &Collections{byPrefix: map[string]*Collection{}}
+	for _, coll := range colls {
+		if strings.Contains(coll.Prefix, "/") {
+			return nil, fmt.Errorf("collection prefix %q can't contain a slash", coll.Prefix)
+		}
+		if _, dup := c.byPrefix[coll.Prefix]; dup {
+			return nil, fmt.Errorf("duplicate collection prefix %q", coll.Prefix)
+		}
+		if err := coll.init(); err != nil {
+			return nil, fmt.Errorf("collection %q: %s", coll.Prefix, err)
+		}
+		c.byPrefix[coll.Prefix] = coll
+	}
+	return c, nil
+}
+
+// Lookup .
+func (c *Collections) Lookup(prefix string) (*Collection, bool) {
+	if c.fallback != nil {
+		return c.fallback, true
+	}
+	coll, ok := c.byPrefix[prefix]
+	return coll, ok
+}
+
+// Find maps an image id, which starts with its collection's prefix if it
+// has one (e.g. scans/ms-12/f1r), to the collection and the identifier
+// within it.  Where a prefix-less collection has an identifier that starts
+// with another collection's prefix, the prefixed collection wins.
+func (c *Collections) Find(id string) (coll *Collection, prefix, identifier string, ok bool) {
+	if c.fallback != nil {
+		return c.fallback, "", id, true
+	}
+	if i := strings.Index(id, "/"); i > 0 {
+		if coll, ok := c.byPrefix[id[:i]]; ok {
+			return coll, id[:i], id[i+1:], true
+		}
+	}
+	coll, ok = c.byPrefix[""]
+	return coll, "", id, ok
+}
+
+// All returns every collection, by prefix.
+func (c *Collections) All() map[string]*Collection {
+	if c.fallback != nil {
+		return map[string]*Collection{"": c.fallback}
+	}
+	return c.byPrefix
+}
+
+func (coll *Collection) init() error {
+	for _, format := range coll.Formats {
+		if !contains(validFormats, format) {
+			return fmt.Errorf("unknown format %q", format)
+		}
+	}
+
+	if coll.Version != 0 && coll.Version != 2 && coll.Version != 3 {
+		return fmt.Errorf("version must be 2 or 3, got %d", coll.Version)
+	}
+	if coll.TileSize < 0 {
+		return fmt.Errorf("tileSize can't be negative, got %d", coll.TileSize)
+	}
+	if err := coll.SizeLimits.validate(); err != nil {
+		return err
+	}
+
+	if err := coll.Access.init(); err != nil {
+		return err
+	}
+
+	resolver, err := newResolver(coll.Resolver)
+	if err != nil {
+		return err
+	}
+	coll.resolver = resolver
+	return nil
+}
+
+func (coll *Collection) version() int {
+	if coll.Version == 0 {
+		return 2
+	}
+	return coll.Version
+}
+
+// AllowsFormat .
+func (coll *Collection) AllowsFormat(format string) bool {
+	return len(coll.Formats) == 0 || contains(coll.Formats, format)
+}
+
+func (rules *AccessRules) init() error {
+	rules.networks = nil
+	for _, cidr := range rules.Networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		rules.networks = append(rules.networks, network)
+	}
+	return nil
+}
+
+// networkOnly says if the rules let requests in by where they come from
+// alone.
+func (rules *AccessRules) networkOnly() bool {
+	return len(rules.Tokens) == 0
+}
+
+// Authorize checks r against the rules, returning 0 if it's allowed or the
+// status to reject it with.
+func (rules *AccessRules) Authorize(r *http.Request) int {
+	if len(rules.networks) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+
+		allowed := false
+		for _, network := range rules.networks {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return http.StatusForbidden
+		}
+	}
+
+	if len(rules.Tokens) > 0 {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return http.StatusUnauthorized
+		}
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		allowed := false
+		for _, valid := range rules.Tokens {
+			if subtle.ConstantTimeCompare(token, []byte(valid)) == 1 {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return http.StatusForbidden
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testContext(t *testing.T, colls []*Collection) Context {
+	cfg := defaultConfig()
+	cfg.Processor = "go"
+	cfg.RenderTimeout = Duration{10 * time.Second}
+	cfg.Collections = colls
+	if err := cfg.validate(noEnv); err != nil {
+		t.Fatalf("Unexpected error building config: %s", err)
+	}
+	metadata, err := NewMetadataStore("")
+	if err != nil {
+		t.Fatalf("Unexpected error opening metadata store: %s", err)
+	}
+	return Context{
+		pool:     NewWorkerPool(2, 8),
+		config:   newLiveConfig(cfg),
+		cache:    NewMemoryCache(0, 0),
+		renders:  newRenderGroup(),
+		metadata: metadata,
+	}
+}
+
+func noEnv(string) string { return "" }
+
+func TestCollectionRouting(t *testing.T) {
+	t.Parallel()
+
+	noCache := CachePolicy{Disabled: true}
+	router := newRouter(testContext(t, []*Collection{
+		{Prefix: "", Resolver: ResolverConfig{Root: "images"}, Cache: noCache},
+		{Prefix: "pngs", Resolver: ResolverConfig{Root: "images"}, Cache: noCache,
+			Formats: []string{"png"}, SizeLimits: SizeLimits{MaxWidth: 200}},
+		{Prefix: "private", Resolver: ResolverConfig{Root: "images"}, Cache: noCache,
+			Access: AccessRules{Tokens: []string{"letmein"}}},
+		{Prefix: "office", Resolver: ResolverConfig{Root: "images"}, Cache: noCache,
+			Access: AccessRules{Networks: []string{"10.0.0.0/8"}}},
+	}))
+
+	tests := []struct {
+		path   string
+		auth   string
+		status int
+	}{
+		{"/sample2/full/50,/0/default.png", "", http.StatusOK},
+		{"/sample2/info.json", "", http.StatusOK},
+		{"/sample2", "", http.StatusSeeOther},
+		{"/pngs/sample2/full/50,/0/default.png", "", http.StatusOK},
+		{"/pngs/sample2/full/50,/0/default.jpg", "", http.StatusNotImplemented},
+		{"/pngs/sample2/full/full/0/default.png", "", http.StatusBadRequest},
+		{"/pngs/sample2/info.json", "", http.StatusOK},
+		{"/nope/sample2/full/50,/0/default.png", "", http.StatusNotFound},
+		{"/nope/sample2/info.json", "", http.StatusNotFound},
+		{"/private/sample2/info.json", "", http.StatusUnauthorized},
+		{"/private/sample2/info.json", "Bearer wrong", http.StatusForbidden},
+		{"/private/sample2/info.json", "Bearer letmein", http.StatusOK},
+		// httptest requests come from 192.0.2.1.
+		{"/office/sample2/info.json", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("expected %d for %s, got: %d", test.status, test.path, w.Code)
+		}
+	}
+}
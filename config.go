@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is everything the server can be configured with.  It's built from,
+// in increasing order of precedence:
+//
+//  1. the defaults in defaultConfig
+//  2. the YAML file named by -config or IIIF_CONFIG (see config.example.yaml)
+//  3. environment variables
+//  4. command line flags
+//
+// On SIGHUP all of the above are read again.  Fields marked reloadable take
+// effect for new requests; changes to the others are ignored with a warning
+// until the next restart.
+type Config struct {
+	Listen    string `yaml:"listen" json:"listen"`
+	CacheDir  string `yaml:"cacheDir" json:"cacheDir"`
+	Workers   int    `yaml:"workers" json:"workers"`
+	QueueSize int    `yaml:"queueSize" json:"queueSize"`
+	// CacheMaxBytes and CacheMaxAge bound the render cache; least recently
+	// used entries go first.  0 means no limit.  CacheMemoryBytes is how
+	// much of it to keep in memory too, 0 for none.
+	CacheMaxBytes    int64    `yaml:"cacheMaxBytes" json:"cacheMaxBytes"`
+	CacheMaxAge      Duration `yaml:"cacheMaxAge" json:"cacheMaxAge"`
+	CacheMemoryBytes int64    `yaml:"cacheMemoryBytes" json:"cacheMemoryBytes"`
+	// MetadataDir is where each source's dimensions, format and so on are
+	// kept between restarts.
+	MetadataDir string `yaml:"metadataDir" json:"metadataDir"`
+
+	// Reloadable.
+	// BaseURL is used for info.json ids and canonical links.  If it's empty
+	// they're built from the request, and from the Forwarded and
+	// X-Forwarded-* headers if TrustForwarded is set.
+	BaseURL        string `yaml:"baseURL" json:"baseURL"`
+	TrustForwarded bool   `yaml:"trustForwarded" json:"trustForwarded"`
+	// RedirectToCanonical sends a 303 to the canonical URI for image
+	// requests that aren't already in canonical form.
+	RedirectToCanonical bool     `yaml:"redirectToCanonical" json:"redirectToCanonical"`
+	Processor           string   `yaml:"processor" json:"processor"`
+	ConvertMemLimit     string   `yaml:"convertMemLimit" json:"convertMemLimit"`
+	RenderTimeout       Duration `yaml:"renderTimeout" json:"renderTimeout"`
+	// MaxPixels caps width*height of any render, whatever the collection's
+	// limits, so a request like 99999,99999 gets a 413.  max and 2.x's full
+	// are fitted within it instead, and info.json gives it as maxArea.  0
+	// means no cap.
+	MaxPixels int    `yaml:"maxPixels" json:"maxPixels"`
+	LogLevel  string `yaml:"logLevel" json:"logLevel"`
+	// Admin guards /metrics and the /admin endpoints.  By default only
+	// loopback addresses get in, without a token, which lets in everyone
+	// if the server is behind a reverse proxy on the same host; set tokens
+	// there.
+	Admin       AccessRules   `yaml:"admin" json:"admin"`
+	Collections []*Collection `yaml:"collections" json:"collections"`
+
+	// Built by validate.
+	processor   Processor
+	collections *Collections
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:           ":8080",
+		CacheDir:         "iiifCache",
+		CacheMaxBytes:    10 << 30,
+		CacheMemoryBytes: 256 << 20,
+		MetadataDir:      "iiifMetadata",
+		Workers:          runtime.NumCPU(),
+		Processor:        "imagemagick",
+		RenderTimeout:    Duration{30 * time.Second},
+		MaxPixels:        100 * 1000 * 1000,
+		LogLevel:         "info",
+		Admin: AccessRules{
+			Networks: []string{"127.0.0.0/8", "::1/128"},
+		},
+	}
+}
+
+// loadConfig builds a validated Config from the command line args (without
+// the program name), the environment as seen through getenv, and the config
+// file they point at.
+func loadConfig(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("iiif-server", flag.ContinueOnError)
+	path := fs.String("config", "", "YAML config file (IIIF_CONFIG)")
+	listen := fs.String("listen", "", "address to listen on, e.g. :8080 (LISTEN, or PORT)")
+	cacheDir := fs.String("cache-dir", "", "where rendered images are cached (CACHE_DIR)")
+	metadataDir := fs.String("metadata-dir", "", "where image metadata is kept (METADATA_DIR)")
+	cacheMaxBytes := fs.Int64("cache-max-bytes", 0, "evict cached renders beyond this many bytes (CACHE_MAX_BYTES)")
+	cacheMemoryBytes := fs.Int64("cache-memory-bytes", 0, "keep this many bytes of hot renders in memory (CACHE_MEMORY_BYTES)")
+	cacheMaxAge := fs.Duration("cache-max-age", 0, "expire cached renders after this long (CACHE_MAX_AGE)")
+	workers := fs.Int("workers", 0, "concurrent renders, defaults to the number of CPUs (WORKERS)")
+	queueSize := fs.Int("queue-size", 0, "renders allowed to wait for a worker (WORKER_QUEUE_SIZE)")
+	baseURL := fs.String("base-url", "", "public URL of the server, defaults to the request's (BASE_URL)")
+	redirectCanonical := fs.Bool("redirect-canonical", false, "303 image requests to their canonical URI (REDIRECT_CANONICAL)")
+	trustForwarded := fs.Bool("trust-forwarded", false, "build URLs from Forwarded/X-Forwarded-* (TRUST_FORWARDED)")
+	processor := fs.String("processor", "", "imagemagick, vips or go (PROCESSOR)")
+	memLimit := fs.String("convert-mem-limit", "", "passed to convert -limit memory (CONVERT_MEM_LIMIT)")
+	maxPixels := fs.Int("max-pixels", 0, "largest width*height we'll render, 0 for no cap (MAX_PIXELS)")
+	renderTimeout := fs.Duration("render-timeout", 0, "give up on renders after this long (RENDER_TIMEOUT)")
+	logLevel := fs.String("log-level", "", "debug, info, warn or error (LOG_LEVEL)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+
+	if *path == "" {
+		*path = getenv("IIIF_CONFIG")
+	}
+	if *path != "" {
+		raw, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(raw, cfg); err != nil {
+			return nil, fmt.Errorf("err parsing %s: %s", *path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(getenv); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "cache-dir":
+			cfg.CacheDir = *cacheDir
+		case "metadata-dir":
+			cfg.MetadataDir = *metadataDir
+		case "cache-max-bytes":
+			cfg.CacheMaxBytes = *cacheMaxBytes
+		case "cache-memory-bytes":
+			cfg.CacheMemoryBytes = *cacheMemoryBytes
+		case "cache-max-age":
+			cfg.CacheMaxAge = Duration{*cacheMaxAge}
+		case "workers":
+			cfg.Workers = *workers
+		case "queue-size":
+			cfg.QueueSize = *queueSize
+		case "base-url":
+			cfg.BaseURL = *baseURL
+		case "redirect-canonical":
+			cfg.RedirectToCanonical = *redirectCanonical
+		case "trust-forwarded":
+			cfg.TrustForwarded = *trustForwarded
+		case "processor":
+			cfg.Processor = *processor
+		case "convert-mem-limit":
+			cfg.ConvertMemLimit = *memLimit
+		case "max-pixels":
+			cfg.MaxPixels = *maxPixels
+		case "render-timeout":
+			cfg.RenderTimeout = Duration{*renderTimeout}
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		}
+	})
+
+	if err := cfg.validate(getenv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) applyEnv(getenv func(string) string) error {
+	if port := getenv("PORT"); port != "" {
+		cfg.Listen = ":" + port
+	}
+
+	strs := map[string]*string{
+		"LISTEN":            &cfg.Listen,
+		"CACHE_DIR":         &cfg.CacheDir,
+		"METADATA_DIR":      &cfg.MetadataDir,
+		"BASE_URL":          &cfg.BaseURL,
+		"PROCESSOR":         &cfg.Processor,
+		"CONVERT_MEM_LIMIT": &cfg.ConvertMemLimit,
+		"LOG_LEVEL":         &cfg.LogLevel,
+	}
+	for name, field := range strs {
+		if v := getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	ints := map[string]*int{
+		"WORKERS":           &cfg.Workers,
+		"WORKER_QUEUE_SIZE": &cfg.QueueSize,
+		"MAX_PIXELS":        &cfg.MaxPixels,
+	}
+	for name, field := range ints {
+		if v := getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("bad %s: %s", name, err)
+			}
+			*field = n
+		}
+	}
+
+	bools := map[string]*bool{
+		"TRUST_FORWARDED":    &cfg.TrustForwarded,
+		"REDIRECT_CANONICAL": &cfg.RedirectToCanonical,
+	}
+	for name, field := range bools {
+		if v := getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("bad %s: %s", name, err)
+			}
+			*field = b
+		}
+	}
+
+	int64s := map[string]*int64{
+		"CACHE_MAX_BYTES":    &cfg.CacheMaxBytes,
+		"CACHE_MEMORY_BYTES": &cfg.CacheMemoryBytes,
+	}
+	for name, field := range int64s {
+		if v := getenv(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad %s: %s", name, err)
+			}
+			*field = n
+		}
+	}
+
+	if v := getenv("CACHE_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("bad CACHE_MAX_AGE: %s", err)
+		}
+		cfg.CacheMaxAge = Duration{d}
+	}
+
+	if v := getenv("RENDER_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("bad RENDER_TIMEOUT: %s", err)
+		}
+		cfg.RenderTimeout = Duration{d}
+	}
+
+	return nil
+}
+
+// validate checks the config and builds the processor and collections it
+// describes.
+func (cfg *Config) validate(getenv func(string) string) error {
+	if cfg.Listen == "" {
+		return errors.New("listen can't be empty")
+	}
+	if cfg.CacheDir == "" {
+		return errors.New("cacheDir can't be empty")
+	}
+	if cfg.CacheMaxBytes < 0 || cfg.CacheMemoryBytes < 0 || cfg.CacheMaxAge.Duration < 0 {
+		return errors.New("cacheMaxBytes, cacheMemoryBytes and cacheMaxAge can't be negative")
+	}
+	if u, err := url.Parse(cfg.BaseURL); cfg.BaseURL != "" &&
+		(err != nil || u.Scheme == "" || u.Host == "") {
+		return fmt.Errorf("baseURL must be an absolute URL, got %q", cfg.BaseURL)
+	}
+	if cfg.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1, got %d", cfg.Workers)
+	}
+	if cfg.QueueSize < 0 {
+		return fmt.Errorf("queueSize can't be negative, got %d", cfg.QueueSize)
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = 4 * cfg.Workers
+	}
+	if cfg.RenderTimeout.Duration <= 0 {
+		return errors.New("renderTimeout must be positive")
+	}
+	if cfg.MaxPixels < 0 {
+		return fmt.Errorf("maxPixels can't be negative, got %d", cfg.MaxPixels)
+	}
+	if _, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	if err := cfg.Admin.init(); err != nil {
+		return fmt.Errorf("admin: %s", err)
+	}
+
+	processor, err := newProcessor(cfg.Processor, cfg.ConvertMemLimit)
+	if err != nil {
+		return err
+	}
+	cfg.processor = processor
+
+	// With no collections configured, serve every prefix from the resolver
+	// described by the environment, like before collections existed.
+	if len(cfg.Collections) == 0 {
+		coll := &Collection{Resolver: resolverConfigFromEnv(getenv)}
+		if err := coll.init(); err != nil {
+			return err
+		}
+		cfg.collections = &Collections{fallback: coll}
+		return nil
+	}
+
+	collections, err := newCollections(cfg.Collections)
+	if err != nil {
+		return err
+	}
+	cfg.collections = collections
+	return nil
+}
+
+// Duration is a time.Duration written as a string like "30s" in config
+// files and JSON.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalYAML .
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// MarshalJSON .
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// liveConfig holds the current Config.  Reloads swap in a whole new one so
+// a request sees a consistent config from start to finish.
+type liveConfig struct {
+	v atomic.Value
+}
+
+func newLiveConfig(cfg *Config) *liveConfig {
+	l := &liveConfig{}
+	l.v.Store(cfg)
+	return l
+}
+
+// Load .
+func (l *liveConfig) Load() *Config {
+	return l.v.Load().(*Config)
+}
+
+// reload re-reads the config and swaps it in, keeping the settings that
+// can't change without a restart.
+func (l *liveConfig) reload(args []string, getenv func(string) string) error {
+	cfg, err := loadConfig(args, getenv)
+	if err != nil {
+		return err
+	}
+
+	old := l.Load()
+	if cfg.Listen != old.Listen || cfg.CacheDir != old.CacheDir ||
+		cfg.CacheMaxBytes != old.CacheMaxBytes || cfg.CacheMaxAge != old.CacheMaxAge ||
+		cfg.CacheMemoryBytes != old.CacheMemoryBytes || cfg.MetadataDir != old.MetadataDir ||
+		cfg.Workers != old.Workers || cfg.QueueSize != old.QueueSize {
+		logrus.Warn("listen, the cache and metadata settings, workers and queueSize need a restart to change")
+		cfg.Listen = old.Listen
+		cfg.CacheDir = old.CacheDir
+		cfg.CacheMaxBytes = old.CacheMaxBytes
+		cfg.CacheMaxAge = old.CacheMaxAge
+		cfg.CacheMemoryBytes = old.CacheMemoryBytes
+		cfg.MetadataDir = old.MetadataDir
+		cfg.Workers = old.Workers
+		cfg.QueueSize = old.QueueSize
+	}
+
+	l.v.Store(cfg)
+	cfg.applyLogLevel()
+	cfg.warnAboutAdmin()
+	return nil
+}
+
+// warnAboutAdmin logs adminWarning, if there is one.
+func (cfg *Config) warnAboutAdmin() {
+	if warning := cfg.adminWarning(); warning != "" {
+		logrus.Warn(warning)
+	}
+}
+
+// adminWarning says why the admin endpoints are open to more people than
+// they look, since behind a reverse proxy on this host every request comes
+// from loopback and only a token keeps them private.
+func (cfg *Config) adminWarning() string {
+	switch {
+	case !cfg.Admin.networkOnly():
+		return ""
+	case len(cfg.Admin.Networks) == 0:
+		return "admin has no networks or tokens, so /metrics and /admin are open to anyone"
+	}
+	return fmt.Sprintf("admin has no tokens, so /metrics and /admin are open to anyone connecting from %s, "+
+		"which behind a reverse proxy on this host is everyone; set admin tokens",
+		strings.Join(cfg.Admin.Networks, ", "))
+}
+
+func (cfg *Config) applyLogLevel() {
+	// validate already made sure this parses.
+	level, _ := logrus.ParseLevel(cfg.LogLevel)
+	logrus.SetLevel(level)
+}
+
+// reloadOnSignal reloads l every time a signal arrives on sigs.
+func (l *liveConfig) reloadOnSignal(sigs <-chan os.Signal, args []string) {
+	for range sigs {
+		if err := l.reload(args, os.Getenv); err != nil {
+			logrus.Errorf("Error reloading config, keeping the old one: %s", err)
+			continue
+		}
+		logrus.Info("Reloaded config")
+	}
+}
+
+// configHandler shows the running config, minus secrets, to clients the
+// admin access rules allow.
+func configHandler(ctx Context, w http.ResponseWriter, r *http.Request) {
+	cfg := ctx.config.Load()
+	if !authorizeAdmin(cfg, w, r) {
+		return
+	}
+
+	out, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		writeError(w, r, internalError(fmt.Errorf("err encoding config: %s", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// authorizeAdmin checks r against the admin access rules, answering it
+// with an error if it's refused.
+func authorizeAdmin(cfg *Config, w http.ResponseWriter, r *http.Request) bool {
+	status := cfg.Admin.Authorize(r)
+	if status == 0 {
+		return true
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="iiif-admin"`)
+	}
+	writeError(w, r, &RequestError{Status: status, Message: "access denied"})
+	return false
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeEnv(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func writeConfig(t *testing.T, dir, yaml string) string {
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatalf("Unexpected error writing config: %s", err)
+	}
+	return path
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := loadConfig([]string{"-config", "config.example.yaml"}, noEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error loading example: %s", err)
+	}
+	if cfg.ConvertMemLimit != "50MiB" || cfg.QueueSize != 16 {
+		t.Errorf("example not applied: %+v", cfg)
+	}
+	for _, prefix := range []string{"", "scans", "archive"} {
+		if _, ok := cfg.collections.Lookup(prefix); !ok {
+			t.Errorf("expected a collection for prefix %q", prefix)
+		}
+	}
+	if _, ok := cfg.collections.Lookup("nope"); ok {
+		t.Errorf("expected no collection for an unknown prefix")
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "iiif-config")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeConfig(t, dir, `
+listen: ":9000"
+cacheDir: fromFile
+processor: go
+renderTimeout: 5s
+workers: 3
+`)
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		listen   string
+		cacheDir string
+		timeout  time.Duration
+		workers  int
+	}{
+		{"defaults", nil, nil, ":8080", "iiifCache", 30 * time.Second, 0},
+		{"file", []string{"-config", path}, nil, ":9000", "fromFile", 5 * time.Second, 3},
+		{"file from env", nil, map[string]string{"IIIF_CONFIG": path},
+			":9000", "fromFile", 5 * time.Second, 3},
+		{"env over file", []string{"-config", path},
+			map[string]string{"PORT": "7777", "CACHE_DIR": "fromEnv", "WORKERS": "5"},
+			":7777", "fromEnv", 5 * time.Second, 5},
+		{"flags over env", []string{"-config", path, "-listen", ":1234", "-render-timeout", "1m"},
+			map[string]string{"PORT": "7777", "RENDER_TIMEOUT": "2s"},
+			":1234", "fromFile", time.Minute, 3},
+	}
+
+	for _, test := range tests {
+		env := test.env
+		if env == nil {
+			env = map[string]string{}
+		}
+		// Keep the defaults test from shelling out to imagemagick.
+		if _, ok := env["PROCESSOR"]; !ok {
+			env["PROCESSOR"] = "go"
+		}
+		cfg, err := loadConfig(test.args, fakeEnv(env))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if cfg.Listen != test.listen || cfg.CacheDir != test.cacheDir ||
+			cfg.RenderTimeout.Duration != test.timeout {
+			t.Errorf("%s: got listen %q, cacheDir %q, timeout %s",
+				test.name, cfg.Listen, cfg.CacheDir, cfg.RenderTimeout)
+		}
+		if test.workers != 0 && cfg.Workers != test.workers {
+			t.Errorf("%s: expected %d workers, got: %d", test.name, test.workers, cfg.Workers)
+		}
+		if cfg.QueueSize != 4*cfg.Workers {
+			t.Errorf("%s: expected queue size to default to 4*workers, got: %d",
+				test.name, cfg.QueueSize)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "iiif-config")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		yaml string
+		env  map[string]string
+		args []string
+	}{
+		{"workers: 0", nil, nil},
+		{"queueSize: -1", nil, nil},
+		{"renderTimeout: nope", nil, nil},
+		{"renderTimeout: 0s", nil, nil},
+		{"logLevel: loud", nil, nil},
+		{"processor: gimp", nil, nil},
+		{"baseURL: /relative", nil, nil},
+		{"admin: {networks: [banana]}", nil, nil},
+		{"unknownKey: 1", nil, nil},
+		{"collections: [{prefix: a/b}]", nil, nil},
+		{"collections: [{prefix: a}, {prefix: a}]", nil, nil},
+		{"collections: [{prefix: a, formats: [bmp]}]", nil, nil},
+		{"", map[string]string{"WORKERS": "lots"}, nil},
+		{"", nil, []string{"-workers", "lots"}},
+	}
+
+	for _, test := range tests {
+		path := writeConfig(t, dir, "processor: go\n"+test.yaml)
+		args := append([]string{"-config", path}, test.args...)
+		if _, err := loadConfig(args, fakeEnv(test.env)); err == nil {
+			t.Errorf("expected an error for %q %v %v", test.yaml, test.env, test.args)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "iiif-config")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeConfig(t, dir, "processor: go\nworkers: 2\nconvertMemLimit: 1MiB\n")
+	args := []string{"-config", path}
+	cfg, err := loadConfig(args, noEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %s", err)
+	}
+	live := newLiveConfig(cfg)
+
+	err = ioutil.WriteFile(path,
+		[]byte("processor: go\nworkers: 8\nconvertMemLimit: 2MiB\nlogLevel: bogus\n"), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error writing config: %s", err)
+	}
+	if err := live.reload(args, noEnv); err == nil {
+		t.Errorf("expected an invalid config to be rejected")
+	}
+	if live.Load() != cfg {
+		t.Errorf("expected a failed reload to keep the old config")
+	}
+
+	err = ioutil.WriteFile(path,
+		[]byte("processor: go\nworkers: 8\nconvertMemLimit: 2MiB\n"), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error writing config: %s", err)
+	}
+	if err := live.reload(args, noEnv); err != nil {
+		t.Fatalf("Unexpected error reloading: %s", err)
+	}
+	reloaded := live.Load()
+	if reloaded.ConvertMemLimit != "2MiB" {
+		t.Errorf("expected convertMemLimit to reload, got: %q", reloaded.ConvertMemLimit)
+	}
+	if reloaded.Workers != 2 {
+		t.Errorf("expected workers to need a restart, got: %d", reloaded.Workers)
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{{
+		Prefix: "secret",
+		Resolver: ResolverConfig{Type: "s3", S3: S3Config{
+			Endpoint: "http://minio", Bucket: "b", SecretKey: "hunter2"}},
+		Access: AccessRules{Tokens: []string{"letmein"}},
+	}})
+	router := newRouter(ctx)
+
+	// httptest requests come from 192.0.2.1, outside the default admin
+	// networks.
+	req := httptest.NewRequest("GET", "/admin/config", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected %d from outside, got: %d", http.StatusForbidden, w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/config", nil)
+	req.RemoteAddr = "127.0.0.1:4321"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d from localhost, got: %d", http.StatusOK, w.Code)
+	}
+
+	body := w.Body.String()
+	for _, secret := range []string{"hunter2", "letmein"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("expected %q to be hidden, got: %s", secret, body)
+		}
+	}
+	if !strings.Contains(body, `"renderTimeout": "10s"`) {
+		t.Errorf("expected a readable renderTimeout, got: %s", body)
+	}
+}
+
+func TestAdminWarning(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		yaml    string
+		warning string
+	}{
+		{"", "open to anyone connecting from 127.0.0.0/8, ::1/128"},
+		{"admin: {networks: []}", "no networks or tokens"},
+		{"admin: {tokens: [letmein]}", ""},
+		{"admin: {networks: [10.0.0.0/8], tokens: [letmein]}", ""},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "iiif-config")
+		if err != nil {
+			t.Fatalf("Unexpected error making temp dir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		cfg, err := loadConfig([]string{"-config", writeConfig(t, dir, test.yaml)}, noEnv)
+		if err != nil {
+			t.Fatalf("Unexpected error loading %q: %s", test.yaml, err)
+		}
+		warning := cfg.adminWarning()
+		if (test.warning == "") != (warning == "") || !strings.Contains(warning, test.warning) {
+			t.Errorf("expected a warning like %q for %q, got: %q", test.warning, test.yaml, warning)
+		}
+	}
+}
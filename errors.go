@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// RequestError is why a request failed: the status to answer with, the
+// request parameter at fault if there is one, and a message that's safe to
+// show the client.  Anything that isn't a RequestError by the time it
+// reaches writeError is a 500.
+type RequestError struct {
+	Status int
+	// Parameter is one of identifier, region, size, rotation, quality or
+	// format, or "" if the problem isn't with any of them.
+	Parameter string
+	Message   string
+	// Err is the underlying cause.  It's logged but never sent.
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	msg := e.Message
+	if e.Parameter != "" {
+		msg = e.Parameter + ": " + msg
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s (%s)", msg, e.Err)
+	}
+	return msg
+}
+
+// badRequest is a 400 for a parameter we couldn't make sense of; err's
+// message is passed on to the client.
+func badRequest(param string, err error) *RequestError {
+	return &RequestError{Status: http.StatusBadRequest, Parameter: param, Message: err.Error()}
+}
+
+func notFound(param, msg string) *RequestError {
+	return &RequestError{Status: http.StatusNotFound, Parameter: param, Message: msg}
+}
+
+func notImplemented(param, msg string) *RequestError {
+	return &RequestError{Status: http.StatusNotImplemented, Parameter: param, Message: msg}
+}
+
+// internalError hides err from the client.
+func internalError(err error) *RequestError {
+	return &RequestError{
+		Status:  http.StatusInternalServerError,
+		Message: "Internal server error",
+		Err:     err,
+	}
+}
+
+// errorBody is the JSON form of a RequestError.
+type errorBody struct {
+	Status    int    `json:"status"`
+	Error     string `json:"error"`
+	Parameter string `json:"parameter,omitempty"`
+	Message   string `json:"message"`
+}
+
+// writeError logs err and sends it as JSON if the client accepts JSON, or as
+// plain text otherwise.  Nothing may have been written to w yet.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	reqErr, ok := err.(*RequestError)
+	if !ok {
+		reqErr = internalError(err)
+	}
+
+	entry := logrus.WithFields(logrus.Fields{
+		"status":    reqErr.Status,
+		"parameter": reqErr.Parameter,
+		"path":      r.URL.Path,
+	})
+	if reqErr.Status >= 500 {
+		entry.Error(reqErr.Error())
+	} else {
+		entry.Info(reqErr.Error())
+	}
+
+	// Whatever the success path set up is wrong for an error.
+	w.Header().Del("Link")
+	w.Header().Del("Content-Length")
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+	w.Header().Del("Cache-Control")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if strings.Contains(r.Header.Get("Accept"), "json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(reqErr.Status)
+		json.NewEncoder(w).Encode(errorBody{
+			Status:    reqErr.Status,
+			Error:     http.StatusText(reqErr.Status),
+			Parameter: reqErr.Parameter,
+			Message:   reqErr.Message,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(reqErr.Status)
+	if reqErr.Parameter != "" {
+		fmt.Fprintf(w, "%d %s: %s: %s\n",
+			reqErr.Status, http.StatusText(reqErr.Status), reqErr.Parameter, reqErr.Message)
+	} else {
+		fmt.Fprintf(w, "%d %s: %s\n",
+			reqErr.Status, http.StatusText(reqErr.Status), reqErr.Message)
+	}
+}
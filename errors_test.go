@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorResponses(t *testing.T) {
+	t.Parallel()
+
+	broken, err := ioutil.TempDir("", "iiif-errors")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %s", err)
+	}
+	defer os.RemoveAll(broken)
+	err = ioutil.WriteFile(filepath.Join(broken, "corrupt.png"), []byte("not a png"), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error writing image: %s", err)
+	}
+
+	ctx := testContext(t, []*Collection{
+		{Prefix: "", Resolver: ResolverConfig{Root: "images"}, Cache: CachePolicy{Disabled: true}},
+		{Prefix: "broken", Resolver: ResolverConfig{Root: broken}, Cache: CachePolicy{Disabled: true}},
+	})
+	router := newRouter(ctx)
+
+	tests := []struct {
+		path   string
+		status int
+		param  string
+	}{
+		{"/sample2/nope/full/0/default.png", http.StatusBadRequest, "region"},
+		{"/sample2/full/big/0/default.png", http.StatusBadRequest, "size"},
+		{"/sample2/full/full/400/default.png", http.StatusBadRequest, "rotation"},
+		{"/sample2/full/full/0/sepia.png", http.StatusBadRequest, "quality"},
+		{"/sample2/full/full/0/default.bmp", http.StatusBadRequest, "format"},
+		{"/sample2/1000,1000,10,10/full/0/default.png", http.StatusBadRequest, "region"},
+		{"/missing/full/full/0/default.png", http.StatusNotFound, "identifier"},
+		{"/missing/info.json", http.StatusNotFound, "identifier"},
+		// The go processor can't write jp2.
+		{"/sample2/full/full/0/default.jp2", http.StatusNotImplemented, "format"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("expected %d for %s, got: %d", test.status, test.path, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("expected a plain text error for %s, got: %s", test.path, ct)
+		}
+		if !strings.Contains(w.Body.String(), test.param+": ") {
+			t.Errorf("expected the body for %s to name %s, got: %s",
+				test.path, test.param, w.Body.String())
+		}
+
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Header.Set("Accept", "application/json")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var body errorBody
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("expected a JSON error for %s, got: %s", test.path, w.Body.String())
+			continue
+		}
+		if body.Status != test.status || body.Parameter != test.param || body.Message == "" {
+			t.Errorf("unexpected error body for %s: %+v", test.path, body)
+		}
+	}
+
+	// Problems reading the source are ours, not the client's.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/broken/corrupt/full/50,/0/default.png", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 for an undecodable source, got: %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), broken) {
+		t.Errorf("expected the cause to stay out of the body, got: %s", w.Body.String())
+	}
+}
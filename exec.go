@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// runCommand runs name with args and returns its stdout.
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	if err := streamCommand(ctx, &stdout, name, args...); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// streamCommand runs name with args, copying its stdout to w as it comes.
+// The process is started in its own process group so that when ctx is done
+// the whole group is killed, not just the direct child; convert in
+// particular likes to spawn delegates (ghostscript, etc).
+func streamCommand(ctx context.Context, w io.Writer, name string, args ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	subprocesses.Add(1, name)
+	defer subprocesses.Add(-1, name)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s",
+				name, err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunCommandKillsProcessGroup(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The backgrounded sleep holds stdout open, so this only returns promptly
+	// if the grandchild is killed along with the shell.
+	start := time.Now()
+	_, err := runCommand(ctx, "sh", "-c", "sleep 10 & sleep 10")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command wasn't killed, took %s", elapsed)
+	}
+}
+
+func TestRunCommandOutput(t *testing.T) {
+	t.Parallel()
+
+	out, err := runCommand(context.Background(), "echo", "-n", "hi")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(out) != "hi" {
+		t.Errorf("expected %q, got: %q", "hi", out)
+	}
+
+	if _, err := runCommand(context.Background(), "false"); err == nil {
+		t.Errorf("expected an error from a failing command")
+	}
+}
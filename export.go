@@ -0,0 +1,429 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archive is where an export's files go.
+type archive interface {
+	// Write adds the file name, a slash-separated path, with data in it.
+	Write(name string, data []byte) error
+	Close() error
+}
+
+// openArchive writes a tarball if out is named like one, or else into the
+// directory out.
+func openArchive(out string) (archive, error) {
+	switch {
+	case strings.HasSuffix(out, ".tar.gz"), strings.HasSuffix(out, ".tgz"):
+		return newTarArchive(out, true)
+	case strings.HasSuffix(out, ".tar"):
+		return newTarArchive(out, false)
+	default:
+		if err := os.MkdirAll(out, os.FileMode(0755)); err != nil {
+			return nil, err
+		}
+		return dirArchive{dir: out}, nil
+	}
+}
+
+// dirArchive writes files under dir.
+type dirArchive struct {
+	dir string
+}
+
+func (a dirArchive) Write(name string, data []byte) error {
+	path := filepath.Join(a.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, os.FileMode(0644))
+}
+
+func (a dirArchive) Close() error {
+	return nil
+}
+
+// tarArchive writes files into a tarball, optionally gzipped.  Writes can
+// come from any goroutine.
+type tarArchive struct {
+	mu  sync.Mutex
+	f   *os.File
+	gz  *gzip.Writer
+	tw  *tar.Writer
+	now time.Time
+}
+
+func newTarArchive(path string, compress bool) (*tarArchive, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &tarArchive{f: f, now: time.Now()}
+	if compress {
+		a.gz = gzip.NewWriter(f)
+		a.tw = tar.NewWriter(a.gz)
+	} else {
+		a.tw = tar.NewWriter(f)
+	}
+	return a, nil
+}
+
+func (a *tarArchive) Write(name string, data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  a.now,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.tw.Write(data)
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.tw.Close()
+	if a.gz != nil {
+		if gzErr := a.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := a.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// exportResponse collects what the router writes for one request.
+type exportResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *exportResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *exportResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *exportResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+// exporter writes static Level 0 copies of images: an info.json that
+// offers only the tiles and sizes, and each of those rendered at the path
+// a viewer will ask for it by.  The renders go through the router, so
+// they're exactly what the server would send.
+type exporter struct {
+	ctx         Context
+	router      http.Handler
+	baseURL     string
+	format      string
+	concurrency int
+	out         archive
+}
+
+// exportImage writes image, returning how many files that took.
+func (e *exporter) exportImage(image imageRef) (int, error) {
+	cfg := e.ctx.config.Load()
+	coll, prefix, identifier, ok := cfg.collections.Find(image.ID)
+	if !ok {
+		return 0, fmt.Errorf("no collection serves %q", image.ID)
+	}
+
+	// Static hosts generally decode %2F before looking for the file, so
+	// slashes in identifiers become directories rather than staying
+	// escaped as they would on the live server.
+	dir := strings.TrimPrefix(iiifPath(prefix, identifier), "/")
+
+	source, err := resolve(context.Background(), coll, identifier, cfg.processor)
+	if err != nil {
+		return 0, err
+	}
+	meta, err := e.ctx.metadata.Lookup(context.Background(), prefix, source, cfg.processor)
+	if err != nil {
+		return 0, err
+	}
+	// The id is a URL, though, so each directory in it is escaped.
+	segments := strings.Split(dir, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	id := e.baseURL + "/" + strings.Join(segments, "/")
+	iReq := InfoReq{Prefix: prefix, Identifier: identifier, Version: coll.version()}
+	info, err := iReq.infoResp(id, coll, meta.Dimensions(), cfg)
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(level0(info, e.format))
+	if err != nil {
+		return 0, err
+	}
+	if err := e.out.Write(dir+"/info.json", append(data, '\n')); err != nil {
+		return 0, err
+	}
+
+	var wi warmInfo
+	if err := json.Unmarshal(data, &wi); err != nil {
+		return 0, err
+	}
+	paths := warmPaths("", wi, e.format)
+	// The whole image at full size is also asked for as max in 3.0.
+	fullSize := fmt.Sprintf("/full/%d,%d/0/default.%s", wi.Width, wi.Height, e.format)
+	maxSize := "/full/max/0/default." + e.format
+
+	var mu sync.Mutex
+	files := 1
+	var firstErr error
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < e.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range queue {
+				names := []string{path}
+				if wi.Context == iiifContext3 && path == fullSize {
+					names = append(names, maxSize)
+				}
+				n, err := e.exportFile(image.Path, path, dir, names)
+				mu.Lock()
+				files += n
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("%s: %s", path, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, path := range paths {
+		queue <- path
+	}
+	close(queue)
+	wg.Wait()
+	return files, firstErr
+}
+
+// exportFile renders path, a request for the image at imagePath, and
+// writes it under dir as each of names and as its canonical form, which is
+// what clients that follow the canonical Link, like most Level 0 ones, ask
+// for.  It says how many files that took.
+func (e *exporter) exportFile(imagePath, path, dir string, names []string) (n int, err error) {
+	req, err := http.NewRequest(http.MethodGet, imagePath+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	// The router matches on the escaped path it finds here, as it would on
+	// a request from the server, so escaped slashes stay in identifiers.
+	req.RequestURI = imagePath + path
+	resp := &exportResponse{header: http.Header{}}
+
+	// iiifHandler gives up on a response that fails part way through by
+	// panicking, for net/http to cut the connection.
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			n, err = 0, errors.New("render failed")
+		}
+	}()
+	e.router.ServeHTTP(resp, req)
+
+	if resp.status != http.StatusOK {
+		return 0, fmt.Errorf("%d: %s", resp.status, strings.TrimSpace(resp.body.String()))
+	}
+	if canonical := canonicalLink(resp.header, e.baseURL+imagePath); canonical != "" &&
+		!contains(names, canonical) {
+		names = append(names, canonical)
+	}
+	for _, name := range names {
+		if err := e.out.Write(dir+name, resp.body.Bytes()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// canonicalLink is the path of the canonical Link in header below base, if
+// there is one.
+func canonicalLink(header http.Header, base string) string {
+	for _, link := range header["Link"] {
+		if !strings.HasSuffix(link, `>;rel="canonical"`) {
+			continue
+		}
+		uri := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>;rel="canonical"`)
+		if strings.HasPrefix(uri, base+"/") {
+			return strings.TrimPrefix(uri, base)
+		}
+	}
+	return ""
+}
+
+// level0 turns info, which describes everything the server can do, into a
+// description of a static export, which only has info's tiles and sizes in
+// format.
+func level0(info interface{}, format string) interface{} {
+	switch info := info.(type) {
+	case *ImageInfo:
+		profile := []interface{}{"http://iiif.io/api/image/2/level0.json"}
+		if format != "jpg" {
+			profile = append(profile, Profile{Formats: []string{format}})
+		}
+		info.Profile = profile
+	case *ImageInfo3:
+		info.Profile = "level0"
+		info.ExtraFormats, info.ExtraQualities, info.ExtraFeatures = nil, nil, nil
+		if format != "jpg" {
+			info.ExtraFormats = []string{format}
+		}
+	}
+	return info
+}
+
+// exportCommand is `iiif-server export`, which writes static Level 0 copies
+// of images, for hosting anywhere that serves files.  It reads the same
+// config as the server and renders with it, but doesn't need one running.
+// Without identifiers it exports every image the resolvers can list.
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("iiif-server export", flag.ContinueOnError)
+	configPath := fs.String("config", "", "the server's YAML config (IIIF_CONFIG)")
+	out := fs.String("out", "", "directory to write to, or a .tar, .tar.gz or .tgz file")
+	baseURL := fs.String("base-url", "", "where the export will be hosted, for info.json ids")
+	prefix := fs.Bool("prefix", false, "export every image under the identifiers given")
+	format := fs.String("format", "jpg", "the format to render")
+	concurrency := fs.Int("concurrency", 0, "renders at once, defaults to workers")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: iiif-server export [flags] [identifier...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" || *baseURL == "" {
+		fs.Usage()
+		return errors.New("export needs -out and -base-url")
+	}
+
+	var configArgs []string
+	if *configPath != "" {
+		configArgs = []string{"-config", *configPath}
+	}
+	cfg, err := loadConfig(configArgs, os.Getenv)
+	if err != nil {
+		return fmt.Errorf("err loading config: %s", err)
+	}
+	if !cfg.processor.Encodes(*format) {
+		return fmt.Errorf("the %s processor can't write %s", cfg.processor.Name(), *format)
+	}
+	// Every path is written as it's asked for, there's nothing to redirect
+	// to, and nothing's rendered twice, so there's no point caching.
+	cfg.BaseURL = strings.TrimRight(*baseURL, "/")
+	cfg.RedirectToCanonical = false
+	for _, coll := range cfg.collections.All() {
+		coll.Cache.Disabled = true
+	}
+	if *concurrency < 1 || *concurrency > cfg.Workers+cfg.QueueSize {
+		*concurrency = cfg.Workers
+	}
+
+	metadata, err := NewMetadataStore(cfg.MetadataDir)
+	if err != nil {
+		return err
+	}
+	ctx := Context{
+		pool:     NewWorkerPool(cfg.Workers, cfg.QueueSize),
+		config:   newLiveConfig(cfg),
+		renders:  newRenderGroup(),
+		metadata: metadata,
+	}
+
+	var images []imageRef
+	targets := fs.Args()
+	if len(targets) == 0 {
+		targets, *prefix = []string{""}, true
+	}
+	for _, target := range targets {
+		if *prefix {
+			found, err := listImages(context.Background(), cfg.collections, target)
+			if err != nil {
+				return err
+			}
+			images = append(images, found...)
+			continue
+		}
+		image, ok := findImage(cfg.collections, target)
+		if !ok {
+			return fmt.Errorf("no collection serves %q", target)
+		}
+		images = append(images, image)
+	}
+
+	dest, err := openArchive(*out)
+	if err != nil {
+		return err
+	}
+	e := &exporter{
+		ctx:         ctx,
+		router:      newRouter(ctx),
+		baseURL:     cfg.BaseURL,
+		format:      *format,
+		concurrency: *concurrency,
+		out:         dest,
+	}
+	return e.exportAll(images)
+}
+
+// exportAll exports images, reporting progress as it goes, and closes the
+// archive.
+func (e *exporter) exportAll(images []imageRef) error {
+	var failed int
+	for i, image := range images {
+		start := time.Now()
+		n, err := e.exportImage(image)
+		if err != nil {
+			failed++
+			fmt.Printf("[%d/%d] %s: %s\n", i+1, len(images), image.ID, err)
+			continue
+		}
+		fmt.Printf("[%d/%d] %s: %d files in %s\n",
+			i+1, len(images), image.ID, n, time.Since(start).Round(time.Millisecond))
+	}
+	if err := e.out.Close(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed to export", failed, len(images))
+	}
+	return nil
+}
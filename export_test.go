@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "iiif-export")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An identifier that needs escaping in a URL.
+	loose := filepath.Join(dir, "loose")
+	if err := os.MkdirAll(filepath.Join(loose, "ms 1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sample, err := ioutil.ReadFile("images/sample2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(loose, "ms 1", "f 1r.png"), sample, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(dir, "config.yaml")
+	err = ioutil.WriteFile(config, []byte(`processor: go
+metadataDir: `+filepath.Join(dir, "metadata")+`
+collections:
+  - prefix: scans
+    tileSize: 64
+    resolver:
+      root: images
+  - prefix: loose
+    resolver:
+      root: `+loose+`
+  - prefix: three
+    version: 3
+    resolver:
+      root: images
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out")
+	err = exportCommand([]string{
+		"-config", config, "-out", out, "-base-url", "https://static.example.org/",
+		"-format", "png", "scans/sample2", "three/sample2",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error exporting: %s", err)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(out, "scans", "sample2", "info.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error reading info.json: %s", err)
+	}
+	var info ImageInfo
+	if err := json.Unmarshal(raw, &info); err != nil {
+		t.Fatalf("Unexpected error decoding info.json: %s", err)
+	}
+	if info.ID != "https://static.example.org/scans/sample2" {
+		t.Errorf("expected the id under the base URL, got: %s", info.ID)
+	}
+	if len(info.Profile) != 2 || info.Profile[0] != "http://iiif.io/api/image/2/level0.json" {
+		t.Errorf("expected a level0 profile offering png, got: %v", info.Profile)
+	}
+
+	// Every tile and size is there, and is what the server would send, at
+	// the path it was asked for and at the canonical one the server links
+	// it to.
+	ctx := testContext(t, []*Collection{
+		{Prefix: "scans", TileSize: 64, Resolver: ResolverConfig{Root: "images"}},
+		{Prefix: "three", Version: 3, Resolver: ResolverConfig{Root: "images"}},
+	})
+	router := newRouter(ctx)
+	exported := func(image string) map[string]bool {
+		raw, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(image), "info.json"))
+		if err != nil {
+			t.Fatalf("Unexpected error reading info.json: %s", err)
+		}
+		var wi warmInfo
+		json.Unmarshal(raw, &wi)
+		paths := warmPaths("", wi, "png")
+		if len(paths) == 0 {
+			t.Fatalf("expected tiles and sizes for %s", image)
+		}
+
+		files := make(map[string]bool)
+		for _, path := range paths {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/"+image+path, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Unexpected %d for %s", w.Code, path)
+			}
+			canonical := canonicalLink(w.Header(), "http://example.com/"+image)
+			if canonical == "" {
+				t.Fatalf("expected a canonical Link for %s, got: %v", path, w.Header()["Link"])
+			}
+			for _, name := range []string{path, canonical} {
+				files[name] = true
+				data, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(image+name)))
+				if err != nil {
+					t.Errorf("expected %s to be exported: %s", name, err)
+					continue
+				}
+				if !bytes.Equal(w.Body.Bytes(), data) {
+					t.Errorf("expected %s to match the server's render", name)
+				}
+			}
+		}
+		return files
+	}
+	files := exported("scans/sample2")
+	if !files["/full/full/0/default.png"] {
+		t.Errorf("expected the 2.x canonical full size, got: %v", files)
+	}
+	exported("three/sample2")
+	if _, err := os.Stat(filepath.Join(out, "three", "sample2", "full", "max", "0", "default.png")); err != nil {
+		t.Errorf("expected the 3.0 full size as max: %s", err)
+	}
+
+	// Files are named by the identifier as it is, and the id escapes it.
+	err = exportCommand([]string{
+		"-config", config, "-out", out, "-base-url", "https://static.example.org",
+		"-format", "png", "loose/ms 1/f 1r",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error exporting: %s", err)
+	}
+	raw, err = ioutil.ReadFile(filepath.Join(out, "loose", "ms 1", "f 1r", "info.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error reading info.json: %s", err)
+	}
+	info = ImageInfo{}
+	if err := json.Unmarshal(raw, &info); err != nil {
+		t.Fatalf("Unexpected error decoding info.json: %s", err)
+	}
+	if info.ID != "https://static.example.org/loose/ms%201/f%201r" {
+		t.Errorf("expected an escaped id, got: %s", info.ID)
+	}
+
+	tarball := filepath.Join(dir, "out.tar.gz")
+	err = exportCommand([]string{
+		"-config", config, "-out", tarball, "-base-url", "https://static.example.org",
+		"-format", "png", "-prefix", "scans/sample2",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error exporting a tarball: %s", err)
+	}
+	f, err := os.Open(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Unexpected error reading tarball: %s", err)
+	}
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error reading tarball: %s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	// sample2 is the only image under it.
+	if len(names) != len(files)+1 || !contains(names, "scans/sample2/info.json") {
+		t.Errorf("expected info.json and %d renders, got: %s", len(files), strings.Join(names, " "))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultCacheControl is what we send for collections that don't set their
+// own.  Renders only change when the source does, and the ETag catches
+// that, so a day is conservative.  Collections with access rules get
+// privateCacheControl instead, so shared caches don't hand their images
+// to whoever asks next.
+const (
+	defaultCacheControl = "public, max-age=86400"
+	privateCacheControl = "private, max-age=86400"
+)
+
+func (coll *Collection) cacheControl() string {
+	switch {
+	case coll.Cache.CacheControl != "":
+		return coll.Cache.CacheControl
+	case len(coll.Access.Networks) > 0 || len(coll.Access.Tokens) > 0:
+		return privateCacheControl
+	}
+	return defaultCacheControl
+}
+
+// entityTag is a strong ETag for the representation named by parts, made
+// from the version in tag, so it changes whenever the source does and, for
+// renders, whenever the processor does.
+func entityTag(tag CacheTag, parts ...string) string {
+	return `"` + md5str(strings.Join(append(parts, tag.Version), "\x00")) + `"`
+}
+
+// setValidators sets the headers that let clients and caches keep a
+// response and check it's still good later.
+func setValidators(w http.ResponseWriter, etag string, modTime time.Time, cacheControl string) {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+}
+
+// notModified answers r with a 304 if its If-None-Match or, failing that,
+// its If-Modified-Since says the client already has the response, as in
+// RFC 7232 section 6.  setValidators must have been called first.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagListMatches(inm, etag) {
+			return false
+		}
+	} else {
+		ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modTime.IsZero() || modTime.Truncate(time.Second).After(ims) {
+			return false
+		}
+	}
+
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagListMatches does the weak comparison If-None-Match calls for between
+// etag and each of the tags in list, or "*".
+func etagListMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// infoETag is the ETag for the info.json of the image in tag, which also
+// depends on the API version and content type it was negotiated in, on the
+// base URL its id is under, and on the collection and server settings
+// that decide the tiles, sizes, limits and formats it offers.
+func infoETag(
+	tag CacheTag,
+	baseURL string,
+	version int,
+	contentType string,
+	coll *Collection,
+	cfg *Config,
+) string {
+	settings := fmt.Sprintf("serves v%d, tiles %d, limits %+v, formats %v, processor %s",
+		coll.version(), coll.TileSize, coll.SizeLimits.capped(cfg.MaxPixels), coll.Formats,
+		cfg.processor.Name())
+	return entityTag(tag, baseURL, tag.ID, fmt.Sprintf("v%d", version), contentType, settings)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{
+		{Resolver: ResolverConfig{Root: "images"}, Cache: CachePolicy{Disabled: true}},
+		{Prefix: "scans", Resolver: ResolverConfig{Root: "images"},
+			Cache: CachePolicy{Disabled: true, CacheControl: "public, max-age=31536000"}},
+		{Prefix: "private", Resolver: ResolverConfig{Root: "images"}, Cache: CachePolicy{Disabled: true},
+			Access: AccessRules{Tokens: []string{"letmein"}}},
+		{Prefix: "intranet", Resolver: ResolverConfig{Root: "images"}, Cache: CachePolicy{Disabled: true},
+			Access: AccessRules{Networks: []string{"192.0.2.0/24"}}},
+		{Prefix: "shared", Resolver: ResolverConfig{Root: "images"},
+			Cache:  CachePolicy{Disabled: true, CacheControl: "public, max-age=60"},
+			Access: AccessRules{Tokens: []string{"letmein"}}},
+	})
+	router := newRouter(ctx)
+
+	info, err := os.Stat("images/sample2.png")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	lastModified := info.ModTime().UTC().Format(http.TimeFormat)
+
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{
+		"/sample2/full/50,/0/default.png",
+		"/sample2/info.json",
+	} {
+		w := get(path, nil)
+		etag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK || len(etag) != 34 || etag[0] != '"' {
+			t.Fatalf("expected a strong ETag for %s, got: %d %q", path, w.Code, etag)
+		}
+		if w.Header().Get("Last-Modified") != lastModified {
+			t.Errorf("expected Last-Modified %s for %s, got: %s",
+				lastModified, path, w.Header().Get("Last-Modified"))
+		}
+		if w.Header().Get("Cache-Control") != defaultCacheControl {
+			t.Errorf("expected the default Cache-Control for %s, got: %s",
+				path, w.Header().Get("Cache-Control"))
+		}
+
+		for _, test := range []struct {
+			headers map[string]string
+			status  int
+		}{
+			{map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+			{map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+			{map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+			{map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+			{map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+			{map[string]string{"If-Modified-Since": info.ModTime().Add(-time.Hour).UTC().Format(http.TimeFormat)},
+				http.StatusOK},
+			// If-None-Match wins.
+			{map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified},
+				http.StatusOK},
+		} {
+			w := get(path, test.headers)
+			if w.Code != test.status {
+				t.Errorf("expected %d for %s with %v, got: %d", test.status, path, test.headers, w.Code)
+			}
+			if w.Code == http.StatusNotModified {
+				if w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+					t.Errorf("expected an empty 304 with the ETag for %s, got: %q %q",
+						path, w.Body.String(), w.Header().Get("ETag"))
+				}
+			}
+		}
+	}
+
+	// Equivalent requests get the same ETag; different ones don't.
+	a := get("/sample2/full/150,/0/default.png", nil).Header().Get("ETag")
+	b := get("/sample2/full/!150,150/0/default.png", nil).Header().Get("ETag")
+	c := get("/sample2/full/151,/0/default.png", nil).Header().Get("ETag")
+	if a != b || a == c {
+		t.Errorf("expected ETags to follow the canonical request, got: %s %s %s", a, b, c)
+	}
+
+	// info.json depends on the negotiated version.
+	v3 := get("/sample2/info.json", map[string]string{
+		"Accept": `application/ld+json;profile="` + iiifContext3 + `"`,
+	})
+	if v3.Header().Get("ETag") == get("/sample2/info.json", nil).Header().Get("ETag") {
+		t.Errorf("expected the 2.x and 3.0 info.json to have different ETags")
+	}
+	if v3.Header().Get("Vary") != "Accept" {
+		t.Errorf("expected Vary: Accept on info.json, got: %q", v3.Header().Get("Vary"))
+	}
+
+	// And on the settings it's built from, so a reload that changes them
+	// isn't answered with a 304 for the old one.
+	before := get("/scans/sample2/info.json", nil).Header().Get("ETag")
+	scans, _ := ctx.config.Load().collections.Lookup("scans")
+	scans.TileSize = 64
+	if get("/scans/sample2/info.json", map[string]string{"If-None-Match": before}).Code != http.StatusOK {
+		t.Errorf("expected a new ETag once the tile size changes")
+	}
+	ctx.config.Load().BaseURL = "https://iiif.example.org"
+	after := get("/scans/sample2/info.json", nil).Header().Get("ETag")
+	ctx.config.Load().BaseURL = ""
+	if after == get("/scans/sample2/info.json", nil).Header().Get("ETag") {
+		t.Errorf("expected a new ETag under a new base URL")
+	}
+
+	// Another processor renders different bytes, so its renders can't share
+	// a strong ETag with the last one's.
+	render := "/sample2/full/50,/0/default.png"
+	before = get(render, nil).Header().Get("ETag")
+	ctx.config.Load().processor = renamedProcessor{name: "other"}
+	after = get(render, map[string]string{"If-None-Match": before}).Header().Get("ETag")
+	ctx.config.Load().processor = GoProcessor{}
+	if after == before {
+		t.Errorf("expected a new ETag for renders by another processor")
+	}
+
+	w := get("/scans/sample2/info.json", nil)
+	if w.Header().Get("Cache-Control") != "public, max-age=31536000" {
+		t.Errorf("expected the collection's Cache-Control, got: %s", w.Header().Get("Cache-Control"))
+	}
+
+	// Restricted collections aren't for shared caches, unless they say so.
+	auth := map[string]string{"Authorization": "Bearer letmein"}
+	for path, expected := range map[string]string{
+		"/private/sample2/info.json":              privateCacheControl,
+		"/private/sample2/full/50,/0/default.png": privateCacheControl,
+		"/intranet/sample2/info.json":             privateCacheControl,
+		"/shared/sample2/info.json":               "public, max-age=60",
+	} {
+		w := get(path, auth)
+		if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != expected {
+			t.Errorf("expected Cache-Control %q for %s, got: %d %q",
+				expected, path, w.Code, w.Header().Get("Cache-Control"))
+		}
+	}
+
+	w = get("/sample2/nope/full/0/default.png", nil)
+	if w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("expected errors not to be cacheable, got: %v", w.Header())
+	}
+}
+
+// renamedProcessor is the go processor under another name.
+type renamedProcessor struct {
+	GoProcessor
+	name string
+}
+
+func (p renamedProcessor) Name() string {
+	return p.name
+}
@@ -1,20 +1,22 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"image"
 	"math"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -36,10 +38,40 @@ const (
 	ErrInvalidQuality = "Invalid quality"
 	// ErrInvalidFormat .
 	ErrInvalidFormat = "Invalid format"
+	// ErrNoSource .
+	ErrNoSource = "No source image found"
+	// ErrInvalidIdentifier .
+	ErrInvalidIdentifier = "Invalid identifier"
+	// ErrSizeOverLimit .
+	ErrSizeOverLimit = "Requested size is over the limit"
+	// ErrUpscaleNotAllowed .
+	ErrUpscaleNotAllowed = "Size is bigger than the region but doesn't start with ^"
+	// ErrNotInVersion .
+	ErrNotInVersion = "Not supported by this IIIF Image API version"
+	// ErrRegionNotPositive .
+	ErrRegionNotPositive = "Region must have a non-negative offset and a positive width and height"
+	// ErrRegionOutsideImage .
+	ErrRegionOutsideImage = "Region is entirely outside the image"
+	// ErrSizeNotPositive .
+	ErrSizeNotPositive = "Size must be positive"
+	// ErrTooManyPixels .
+	ErrTooManyPixels = "Requested image has too many pixels"
+	// ErrDimensionTooLarge .
+	ErrDimensionTooLarge = "Requested width or height is too large"
 )
 
+// maxDimension is the widest or tallest output we'll even consider.  No
+// processor can render anything near it, and keeping sizes under it keeps
+// the arithmetic done on them well away from overflowing.
+const maxDimension = 1 << 24
+
 var validFormats = []string{"jpg", "tif", "png", "gif", "jp2", "pdf", "webp"}
 
+// When an identifier exists in several formats, masters are picked in this
+// order: lossless and pyramidal first, since they're the cheapest to cut
+// tiles from and lose nothing when transcoded.
+var sourcePreference = []string{"jp2", "tif", "png", "webp", "jpg", "gif", "pdf"}
+
 // WidthHeight .
 type WidthHeight struct {
 	Width  int
@@ -51,6 +83,8 @@ type InfoReq struct {
 	Req        *http.Request
 	Prefix     string
 	Identifier string
+	// Version is the major IIIF Image API version to answer with.
+	Version int
 }
 
 // ImageReq represents a request for IIIF image
@@ -63,10 +97,19 @@ type ImageReq struct {
 	Rotation   interface{}
 	Format     string
 	Quality    string
-}
-
-func (imgReq ImageReq) toPath() string {
-	return "images/" + imgReq.Identifier + "." + imgReq.Format
+	// Limits are the collection's, enforced when the output size is known.
+	Limits SizeLimits
+	// Version is the major IIIF Image API version the request is handled
+	// under, which is the collection's.
+	Version int
+	// Upscale is set by a leading ^ on the size, which 3.0 requires before
+	// the output can be bigger than the region.
+	Upscale bool
+	// Stats are the source's dimensions, once they're known.
+	Stats WidthHeight
+	// MaxPixels is the server's cap on width*height, which max and full
+	// are fitted within rather than refused.
+	MaxPixels int
 }
 
 // SizeFull .
@@ -100,10 +143,19 @@ type SizeBestFit struct {
 	Height int
 }
 
+// SizeMax is the region as big as the limits allow, without upscaling
+// unless the request asked for it with ^max.
+type SizeMax struct {
+}
+
 // RegionFull .
 type RegionFull struct {
 }
 
+// RegionSquare is the largest square in the middle of the image.
+type RegionSquare struct {
+}
+
 // Region derived from original size and a region transformation
 // ^ Is this comment out of date?
 type Region struct {
@@ -147,25 +199,31 @@ type ImageInfo struct {
 	Width    int           `json:"width"`
 	Height   int           `json:"height"`
 	Profile  []interface{} `json:"profile"`
+	Tiles    []Tile        `json:"tiles,omitempty"`
+	Sizes    []InfoSize    `json:"sizes,omitempty"`
 }
 
 // Profile .
 type Profile struct {
-	Context *string  `json:"@context"`
-	ID      *string  `json:"@id"`
-	Type    *string  `json:"@type"`
-	Formats []string `json:"formats"`
-}
-
-// Job .
-type Job struct {
-	Cmd      string
-	RespChan chan []byte
+	Context   *string  `json:"@context"`
+	ID        *string  `json:"@id"`
+	Type      *string  `json:"@type"`
+	Formats   []string `json:"formats"`
+	Qualities []string `json:"qualities,omitempty"`
+	Supports  []string `json:"supports,omitempty"`
+	MaxWidth  int      `json:"maxWidth,omitempty"`
+	MaxHeight int      `json:"maxHeight,omitempty"`
+	MaxArea   int      `json:"maxArea,omitempty"`
 }
 
-// Context .
+// Context holds the state shared by handlers.  Handlers should Load the
+// config once per request, since a SIGHUP can swap it at any time.
 type Context struct {
-	workerChan chan string
+	pool     *WorkerPool
+	config   *liveConfig
+	cache    Cache
+	renders  *renderGroup
+	metadata *MetadataStore
 }
 
 // ContextHandler .
@@ -174,61 +232,133 @@ type ContextHandler struct {
 	handler func(ctx Context, w http.ResponseWriter, r *http.Request)
 }
 
+func (h ContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler(h.ctx, w, r)
+}
+
 func main() {
-	// TODO(cgag): need a worker pool (num cpus)
 	// TODO(cgag): need memory limits as well.
 
-	jobChan := make(chan Job)
-	// TODO(cgag): more workers? or can we rely on imagemagic to use
-	// use all the cores?  Is it worth breaking imagemagick's memory usage
-	// heuristics?
-	go func() {
-		for {
-			job := <-jobChan
-			fmt.Printf("cmd :%s\n", job.Cmd)
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"purge":  purgeCommand,
+			"warm":   warmCommand,
+			"export": exportCommand,
 		}
-	}()
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		}
+	}
+
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		logrus.Fatalf("Error loading config: %s", err)
+	}
+	cfg.applyLogLevel()
+	cfg.warnAboutAdmin()
 
-	router := mux.NewRouter()
+	logrus.Infof("Starting %d workers, queue size %d", cfg.Workers, cfg.QueueSize)
+	logrus.Infof("Rendering with %s", cfg.processor.Name())
 
-	router.HandleFunc("/", helloHandler)
-	// TODO(cgag): prefix is optional, need to handle that as well
-	router.HandleFunc("/{prefix}/{identifier}", baseRedirect)
-	router.HandleFunc(
-		"/{prefix}/{identifier}/{region}/{size}/{rotation}/{quality}.{format}",
-		iiifHandler)
-	router.HandleFunc("/{prefix}/{identifier}/info.json", infoHandler)
+	live := newLiveConfig(cfg)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go live.reloadOnSignal(hup, os.Args[1:])
+
+	disk, err := NewDiskCache(cfg.CacheDir, cfg.CacheMaxBytes, cfg.CacheMaxAge.Duration)
+	if err != nil {
+		logrus.Fatalf("Error opening cache: %s", err)
+	}
+	var cache Cache = disk
+	if cfg.CacheMemoryBytes > 0 {
+		cache = NewTieredCache(NewMemoryCache(cfg.CacheMemoryBytes, cfg.CacheMaxAge.Duration), disk)
+	}
+
+	metadata, err := NewMetadataStore(cfg.MetadataDir)
+	if err != nil {
+		logrus.Fatalf("Error opening metadata store: %s", err)
+	}
+
+	ctx := Context{
+		pool:     NewWorkerPool(cfg.Workers, cfg.QueueSize),
+		config:   live,
+		cache:    cache,
+		renders:  newRenderGroup(),
+		metadata: metadata,
+	}
+
+	router := newRouter(ctx)
 
-	// TODO(cgag): Get port from env with a default
 	s := &http.Server{
-		Addr:    ":8080",
-		Handler: mkLoggingHandler(router),
+		Addr:    cfg.Listen,
+		Handler: mkLoggingHandler(instrument(router)),
 	}
 
 	logrus.Infof("Listening on: %s", s.Addr)
-	err := s.ListenAndServe()
+	err = s.ListenAndServe()
 	if err != nil {
 		logrus.Errorf("Error starting server: %#v", s)
 	}
 }
 
-func baseRedirect(w http.ResponseWriter, r *http.Request) {
+func newRouter(ctx Context) *mux.Router {
+	// Keep %2F escaped while matching so identifiers can contain slashes.
+	router := mux.NewRouter().UseEncodedPath()
+
+	// Routes are named for the metrics.
+	router.HandleFunc("/", helloHandler).Name("hello")
+	// Before /{identifier} so they aren't taken for identifiers, and
+	// /{prefix}/{identifier} so "admin" isn't taken for a prefix.
+	router.Handle("/metrics", ContextHandler{ctx, metricsHandler}).Name("metrics")
+	router.Handle("/admin/config", ContextHandler{ctx, configHandler}).Name("admin")
+	router.Handle("/admin/cache", ContextHandler{ctx, cacheStatsHandler}).Name("admin")
+	router.Handle("/admin/purge", ContextHandler{ctx, purgeHandler}).Name("admin")
+	router.Handle("/admin/images", ContextHandler{ctx, imagesHandler}).Name("admin")
+
+	// The prefix-less info.json has to come before /{prefix}/{identifier},
+	// which would otherwise match it.
+	router.Handle("/{identifier}/info.json",
+		ContextHandler{ctx, infoHandler}).Name("info")
+	router.Handle(
+		"/{identifier}/{region}/{size}/{rotation}/{quality}.{format}",
+		ContextHandler{ctx, iiifHandler}).Name("image")
+	router.Handle("/{identifier}", ContextHandler{ctx, baseRedirect}).Name("base")
+
+	router.Handle("/{prefix}/{identifier}", ContextHandler{ctx, baseRedirect}).Name("base")
+	router.Handle(
+		"/{prefix}/{identifier}/{region}/{size}/{rotation}/{quality}.{format}",
+		ContextHandler{ctx, iiifHandler}).Name("image")
+	router.Handle("/{prefix}/{identifier}/info.json",
+		ContextHandler{ctx, infoHandler}).Name("info")
+
+	return router
+}
+
+func baseRedirect(ctx Context, w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	prefix, ok := vars["prefix"]
-	if !ok {
-		logrus.Error("Failed to parse prefix from URL")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
+	// No prefix is fine, see the routes in main.
+	prefix := vars["prefix"]
 
 	identifier, ok := vars["identifier"]
 	if !ok {
-		logrus.Error("Failed to parse identifier from URL")
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, badRequest("identifier", errors.New("Failed to parse identifier from URL")))
 		return
 	}
 
-	http.Redirect(w, r, "/"+prefix+"/"+identifier+"/info.json", http.StatusSeeOther)
+	// Absolute, so it survives a proxy that mounts us under a path prefix.
+	base := ctx.config.Load().baseURL(r)
+	http.Redirect(w, r, base+iiifPath(prefix, identifier)+"/info.json", http.StatusSeeOther)
+}
+
+// iiifPath is the base path of an image, with or without a prefix.
+func iiifPath(prefix, identifier string) string {
+	if prefix == "" {
+		return "/" + identifier
+	}
+	return "/" + prefix + "/" + identifier
 }
 
 func helloHandler(w http.ResponseWriter, r *http.Request) {
@@ -242,268 +372,479 @@ func md5str(s string) string {
 	return hex.EncodeToString(b[:])
 }
 
-func iiifHandler(w http.ResponseWriter, r *http.Request) {
+func iiifHandler(ctx Context, w http.ResponseWriter, r *http.Request) {
+	imgReq, err := imageReq(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	cfg := ctx.config.Load()
+	coll, err := lookupCollection(cfg, w, r, imgReq.Prefix)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	cacheDir := "iiifCache"
-	if err := os.Mkdir(cacheDir, os.FileMode(0755)); err != nil {
-		if !os.IsExist(err) {
-			logrus.Errorf("err creating cache dir: %s", err)
-			w.WriteHeader(http.StatusBadRequest)
+	if !coll.AllowsFormat(imgReq.Format) {
+		writeError(w, r, notImplemented("format",
+			fmt.Sprintf("%s isn't offered for this collection", imgReq.Format)))
+		return
+	}
+
+	imgReq.Version = coll.version()
+	if imgReq.Version < 3 {
+		// ^ is 3.0 syntax.  2.x upscales whenever it's asked to.
+		if imgReq.Upscale {
+			writeError(w, r, badRequest("size", errors.New(ErrNotInVersion)))
 			return
 		}
+	} else if _, ok := imgReq.Size.(SizeFull); ok {
+		// 3.0 dropped full in favour of max.
+		writeError(w, r, badRequest("size", errors.New(ErrNotInVersion)))
+		return
 	}
 
-	cacheFilepath := cacheDir + "/" + md5str(r.URL.String())
+	imgReq.Limits = coll.SizeLimits
+	imgReq.MaxPixels = cfg.MaxPixels
+	if err := imgReq.Limits.checkRequested(imgReq.Size); err != nil {
+		writeError(w, r, badRequest("size", err))
+		return
+	}
 
-	// TODO(cgag): all these hardcoded /'s fuck up portability
-	cachedFile, err := os.Open(cacheFilepath)
+	source, err := resolve(r.Context(), coll, imgReq.Identifier, cfg.processor)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			logrus.Errorf("Unforseen problem opening cached file: %s", err)
-			w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err)
+		return
+	}
+	src := source.Path
+
+	if !cfg.processor.Encodes(imgReq.Format) {
+		writeError(w, r, notImplemented("format",
+			fmt.Sprintf("the %s processor can't write %s", cfg.processor.Name(), imgReq.Format)))
+		return
+	}
+
+	// Bound the render by both the client's connection and our own deadline,
+	// whichever goes first.
+	renderCtx, cancel := context.WithTimeout(r.Context(), cfg.RenderTimeout.Duration)
+	defer cancel()
+
+	// Regions off the image, the limits, 3.0's upscaling rule and the
+	// canonical form all need the image's dimensions, so this is where bad
+	// requests get caught rather than as failed renders.
+	meta, err := ctx.metadata.Lookup(renderCtx, imgReq.Prefix, source, cfg.processor)
+	if err != nil {
+		if renderAborted(w, r, renderCtx, err, imgReq) {
 			return
 		}
+		writeError(w, r, internalError(fmt.Errorf("err sizing %s: %s", src, err)))
+		return
+	}
+	stats := meta.Dimensions()
+	imgReq.Stats = stats
+	_, size, err := imgReq.geometry(stats)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !imgReq.Limits.Allows(size) {
+		writeError(w, r, badRequest("size",
+			fmt.Errorf("%s: %dx%d", ErrSizeOverLimit, size.Width, size.Height)))
+		return
+	}
+	if cfg.MaxPixels > 0 && overArea(size, cfg.MaxPixels) {
+		writeError(w, r, &RequestError{
+			Status:    http.StatusRequestEntityTooLarge,
+			Parameter: "size",
+			Message:   fmt.Sprintf("%s: %dx%d", ErrTooManyPixels, size.Width, size.Height),
+		})
+		return
 	}
 
-	imgReq, err := imageReq(r)
+	canonical, err := imgReq.canonicalPath(stats)
 	if err != nil {
-		logrus.Errorf("error with imageReq: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err)
+		return
+	}
+	base := cfg.baseURL(r)
+	if cfg.RedirectToCanonical && canonical != r.URL.EscapedPath() {
+		http.Redirect(w, r, base+canonical, http.StatusSeeOther)
 		return
 	}
 
-	w.Header().Set("Link", "<http://iiif.io/api/image/2/level1.json>;rel=\"profile\"")
+	w.Header().Set("Link", profileLink(imgReq.Version))
+	w.Header().Add("Link", "<"+base+canonical+">;rel=\"canonical\"")
 	w.Header().Set("Content-Type", mime.TypeByExtension("."+imgReq.Format))
 
-	if cachedFile != nil {
-		logrus.Info("cache hit")
-		bytes, err := ioutil.ReadAll(cachedFile)
-		if err != nil {
-			logrus.Error("couldn't read cached file")
-			w.WriteHeader(http.StatusBadRequest)
+	// Equivalent requests share a cache entry, and an ETag.
+	cacheKey := md5str(canonical)
+	// Renders of an older version of the source, or by another processor,
+	// are misses, and have another ETag.
+	cacheTag := renderTag(imgReq.Prefix, source, cfg.processor)
+
+	etag := entityTag(cacheTag, canonical)
+	setValidators(w, etag, source.ModTime, coll.cacheControl())
+	if notModified(w, r, etag, source.ModTime) {
+		return
+	}
+
+	if !coll.Cache.Disabled {
+		if entry, ok := ctx.cache.Open(cacheKey, cacheTag); ok {
+			defer entry.Close()
+			cacheLookups.Inc("hit")
+			logrus.Info("cache hit")
+			http.ServeContent(w, r, "", source.ModTime, entry)
 			return
 		}
-		w.Write(bytes)
-		return
+		cacheLookups.Inc("miss")
 	}
 
 	logrus.Info("cache miss")
 
-	if !imgExists(imgReq.toPath()) {
-		logrus.Infof("no such image: %s", imgReq.toPath())
-		w.WriteHeader(http.StatusNotFound)
-		return
+	// Misses are streamed as they're rendered, so Range is ignored.
+	client := &clientWriter{w: w}
+	defer client.detach()
+
+	var shared bool
+	if coll.Cache.Disabled {
+		err = ctx.render(renderCtx, cfg, src, imgReq, client)
+	} else {
+		// Identical requests arriving while this renders wait for it, then
+		// read it from the cache.
+		shared, err = ctx.renders.Do(renderCtx, cacheKey, cfg.RenderTimeout.Duration,
+			func(sharedCtx context.Context) error {
+				return ctx.renderToCache(sharedCtx, cfg, src, imgReq, cacheKey, cacheTag, client)
+			})
+	}
+	if err == nil && shared {
+		logrus.Debug("joined an in-flight render")
+		if entry, ok := ctx.cache.Open(cacheKey, cacheTag); ok {
+			defer entry.Close()
+			http.ServeContent(w, r, "", source.ModTime, entry)
+			return
+		}
+		// It didn't make it into the cache, so we need our own.
+		err = ctx.render(renderCtx, cfg, src, imgReq, client)
 	}
 
-	args, err := imgReq.buildArgs()
 	if err != nil {
-		logrus.Errorf("%s", err)
-		fmt.Fprintf(w, "Error with request:  %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		// A shared render carries on without us, and mustn't write to w
+		// while we write the error, or after we've returned.
+		client.detach()
+	}
+	if err == ErrQueueFull {
+		logrus.Warnf("rejecting request, queue depth %d", ctx.pool.QueueDepth())
+		w.Header().Set("Retry-After", strconv.Itoa(ctx.pool.RetryAfter()))
+		writeError(w, r, &RequestError{
+			Status:  http.StatusServiceUnavailable,
+			Message: err.Error(),
+		})
 		return
 	}
+	if err != nil {
+		if client.written() > 0 {
+			// Too late for an error status.  Cutting the connection at
+			// least tells the client the image is incomplete.
+			logrus.Errorf("err rendering %s after %d bytes: %s", src, client.written(), err)
+			panic(http.ErrAbortHandler)
+		}
+		if renderAborted(w, r, renderCtx, err, imgReq) {
+			return
+		}
+		if _, ok := err.(*RequestError); ok {
+			// The processor found something it won't do, like a source too
+			// big to decode.
+			writeError(w, r, err)
+			return
+		}
+		writeError(w, r, internalError(fmt.Errorf("err rendering %s: %s", src, err)))
+	}
+}
+
+// lookupCollection finds the collection for prefix and checks r against its
+// access rules.  A 401 also sets WWW-Authenticate on w.
+func lookupCollection(
+	cfg *Config,
+	w http.ResponseWriter,
+	r *http.Request,
+	prefix string,
+) (*Collection, error) {
+	coll, ok := cfg.collections.Lookup(prefix)
+	if !ok {
+		return nil, notFound("", fmt.Sprintf("unknown prefix %q", prefix))
+	}
+
+	if status := coll.Access.Authorize(r); status != 0 {
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="iiif"`)
+		}
+		return nil, &RequestError{Status: status, Message: "access denied"}
+	}
+
+	return coll, nil
+}
+
+// resolve finds the master for identifier, turning a miss into a 404 and
+// any other failure, which is the origin's, into a 502.
+func resolve(
+	ctx context.Context,
+	coll *Collection,
+	identifier string,
+	processor Processor,
+) (*Source, error) {
+	source, err := coll.resolver.Resolve(ctx, identifier, sourceFormats(processor))
+	if err != nil && err.Error() == ErrNoSource {
+		return nil, notFound("identifier", ErrNoSource)
+	}
+	if err != nil {
+		return nil, &RequestError{
+			Status:  http.StatusBadGateway,
+			Message: "couldn't fetch the source image",
+			Err:     fmt.Errorf("err resolving %s: %s", identifier, err),
+		}
+	}
+	return source, nil
+}
 
-	splitArgs := strings.Split(strings.TrimSpace(args), " ")
-	out, err := exec.Command("convert", splitArgs...).Output()
+// statusClientClosedRequest is nginx's non-standard code for a client that
+// hung up before we responded.  Nobody will see it but our own logs.
+const statusClientClosedRequest = 499
+
+// renderAborted reports whether renderCtx ended because the client went away
+// or the render deadline passed, and if so logs the outcome and writes the
+// matching status.  err is what the render failed with, which is a
+// DeadlineExceeded of its own if it was shared with a request that started
+// before this one.
+func renderAborted(
+	w http.ResponseWriter,
+	r *http.Request,
+	renderCtx context.Context,
+	err error,
+	imgReq ImageReq,
+) bool {
+	fields := logrus.Fields{
+		"prefix":     imgReq.Prefix,
+		"identifier": imgReq.Identifier,
+	}
+
+	if r.Context().Err() != nil {
+		fields["outcome"] = "client_closed"
+		logrus.WithFields(fields).Warn("client went away, render cancelled")
+		w.WriteHeader(statusClientClosedRequest)
+		return true
+	}
+
+	if renderCtx.Err() == context.DeadlineExceeded || err == context.DeadlineExceeded {
+		fields["outcome"] = "timeout"
+		logrus.WithFields(fields).Error("render timed out")
+		writeError(w, r, &RequestError{
+			Status:  http.StatusGatewayTimeout,
+			Message: "render timed out",
+		})
+		return true
+	}
+
+	return false
+}
+
+func infoHandler(ctx Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	iReq, err := infoReq(r)
 	if err != nil {
-		logrus.Errorf("err running convert: %s", err)
-		logrus.Errorf("args were: %s", args)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	// write cache
-	err = ioutil.WriteFile(cacheFilepath, out, os.FileMode(0755))
+	cfg := ctx.config.Load()
+	coll, err := lookupCollection(cfg, w, r, iReq.Prefix)
 	if err != nil {
-		logrus.Errorf("err writing file: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write(out)
-}
+	iReq.Version = negotiateVersion(r, coll.version())
+	contentType := infoContentType(r, iReq.Version)
+	w.Header().Set("Vary", "Accept")
 
-func infoHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	source, err := resolve(r.Context(), coll, iReq.Identifier, cfg.processor)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	wants, ok := r.Header["Accept"]
-	if !ok || wants[0] == "application/json" {
-		w.Header().Set("Content-Type", "application/json")
-	} else if wants[0] == "application/ld+json" {
-		w.Header().Set("Content-Type", "application/ld+json")
+	baseURL := cfg.baseURL(r)
+	etag := infoETag(sourceTag(iReq.Prefix, source), baseURL, iReq.Version, contentType, coll, cfg)
+	setValidators(w, etag, source.ModTime, coll.cacheControl())
+	if notModified(w, r, etag, source.ModTime) {
+		return
 	}
 
-	iReq := infoReq(r)
-	iResp, err := iReq.infoResp()
+	// Identifying a source can be as slow as rendering it, so it gets the
+	// same deadline.
+	identifyCtx, cancel := context.WithTimeout(r.Context(), cfg.RenderTimeout.Duration)
+	defer cancel()
+	meta, err := ctx.metadata.Lookup(identifyCtx, iReq.Prefix, source, cfg.processor)
 	if err != nil {
-		logrus.Errorf("err handling info request: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		imgReq := ImageReq{Prefix: iReq.Prefix, Identifier: iReq.Identifier}
+		if renderAborted(w, r, identifyCtx, err, imgReq) {
+			return
+		}
+		writeError(w, r, internalError(fmt.Errorf("err sizing %s: %s", source.Path, err)))
 		return
 	}
+	id := baseURL + iiifPath(iReq.Prefix, url.PathEscape(iReq.Identifier))
+	iResp, err := iReq.infoResp(id, coll, meta.Dimensions(), cfg)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
 
 	if err = json.NewEncoder(w).Encode(iResp); err != nil {
 		logrus.Errorf("Error encoding infoResponse to JSON: %#v", iResp)
 	}
 }
 
-func (iReq InfoReq) infoResp() (*ImageInfo, error) {
-	formats, err := getFormats(iReq.Identifier)
-	if err != nil {
-		return nil, err
+// infoResp describes the image, stats big, which is served at id.  The
+// limits it gives are the collection's, tightened by the server's MaxPixels.
+func (iReq InfoReq) infoResp(
+	id string,
+	coll *Collection,
+	stats WidthHeight,
+	cfg *Config,
+) (interface{}, error) {
+	// Any source can be transcoded to anything the processor can write.
+	var formats []string
+	for _, format := range validFormats {
+		if cfg.processor.Encodes(format) && coll.AllowsFormat(format) {
+			formats = append(formats, format)
+		}
+	}
+
+	limits := coll.SizeLimits.capped(cfg.MaxPixels)
+	tiles := infoTiles(stats, coll.TileSize, limits)
+	sizes := infoSizes(stats, tiles[0].ScaleFactors, limits)
+
+	if iReq.Version >= 3 {
+		var extraFormats []string
+		for _, format := range formats {
+			if !contains(level2Formats, format) {
+				extraFormats = append(extraFormats, format)
+			}
+		}
+		return &ImageInfo3{
+			Context:        iiifContext3,
+			ID:             id,
+			Type:           "ImageService3",
+			Protocol:       "http://iiif.io/api/image",
+			Profile:        "level2",
+			Width:          stats.Width,
+			Height:         stats.Height,
+			MaxWidth:       limits.MaxWidth,
+			MaxHeight:      limits.MaxHeight,
+			MaxArea:        limits.MaxArea,
+			Tiles:          tiles,
+			Sizes:          sizes,
+			ExtraFormats:   extraFormats,
+			ExtraQualities: extraQualities3,
+			ExtraFeatures:  servedFeatures(extraFeatures3, coll.version()),
+		}, nil
 	}
 
 	profiles := []interface{}{"http://iiif.io/api/image/2/level2.json"}
 	profiles = append(profiles, Profile{
-		Formats: formats,
+		Formats:   formats,
+		Qualities: qualities2,
+		Supports:  servedFeatures(extraFeatures2, coll.version()),
+		MaxWidth:  limits.MaxWidth,
+		MaxHeight: limits.MaxHeight,
+		MaxArea:   limits.MaxArea,
 	})
 
-	stats, err := imgStats("./images/" + iReq.Identifier + "." + formats[0])
-	if err != nil {
-		return nil, err
-	}
-
 	return &ImageInfo{
-		Context:  "http://iiif.io/api/image/2/context.json",
-		ID:       "https://iiif.curtis.io" + "/" + iReq.Prefix + "/" + iReq.Identifier,
+		Context:  iiifContext2,
+		ID:       id,
 		Protocol: "http://iiif.io/api/image",
 		Profile:  profiles,
 		Width:    stats.Width,
 		Height:   stats.Height,
+		Tiles:    tiles,
+		Sizes:    sizes,
 	}, nil
 }
 
-func getFormats(identifier string) ([]string, error) {
-	// TODO(cgag): parallelize?
-	var found []string
-	for _, format := range validFormats {
-		path := "./images/" + identifier + "." + format
-		if _, err := os.Stat(path); err == nil {
-			found = append(found, format)
-		}
-	}
-	return found, nil
-}
-
-func imgExists(path string) bool {
-	_, err := os.Stat(path)
-	if err != nil {
-		return false
-	}
-	return true
-}
-
-func imgStats(filepath string) (WidthHeight, error) {
+func imgStats(ctx context.Context, filepath string) (WidthHeight, error) {
 	out, err :=
-		exec.Command("identify", "-ping", "-format", "%w,%h", filepath).Output()
+		runCommand(ctx, "identify", "-ping", "-format", "%w,%h", filepath)
 	if err != nil {
 		return WidthHeight{}, err
 	}
 	return parseWidthHeight(string(out))
 }
 
-func (imgReq ImageReq) buildArgs() (string, error) {
+func (imgReq ImageReq) buildArgs(
+	ctx context.Context,
+	src string,
+	convertMemLimit string,
+) ([]string, error) {
 	// TODO(cgag): a tempfile system for caching?
 
-	// TODO(cgag): do this once in main...
-	convertMemLimit := os.Getenv("CONVERT_MEM_LIMIT")
+	stats := imgReq.Stats
+	if stats == (WidthHeight{}) {
+		var err error
+		if stats, err = imgStats(ctx, src); err != nil {
+			return nil, err
+		}
+	}
 
-	stats, err := imgStats(imgReq.toPath())
+	region, err := regionRect(imgReq.Region, stats)
+	if err != nil {
+		return nil, err
+	}
+	regionWH := WidthHeight{Width: region.Dx(), Height: region.Dy()}
+	out, err := imgReq.outputFor(regionWH)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if !imgReq.Limits.Allows(out) {
+		return nil, fmt.Errorf("%s: %dx%d", ErrSizeOverLimit, out.Width, out.Height)
 	}
 
-	args := ""
-	switch imgReq.Region.(type) {
-	case RegionFull:
-		break
-	case RegionExact:
-		region := imgReq.Region.(RegionExact)
-		args = fmt.Sprintf(
-			"%s -crop %dx%d+%d+%d",
-			args,
-			region.Width,
-			region.Height,
-			region.X,
-			region.Y)
-	case RegionPercent:
-		region := imgReq.Region.(RegionPercent)
-		offsetX := int(round(float64(stats.Width) * region.X / 100.0))
-		offsetY := int(round(float64(stats.Height) * region.Y / 100.0))
-		args = fmt.Sprintf(
-			"%s -crop %f%%x%f+%d+%d",
-			args,
-			region.Width,
-			region.Height,
-			offsetX,
-			offsetY,
-		)
-	default:
-		return "", fmt.Errorf("Unrecognized region type: %v", imgReq.Region)
+	// The arguments go to convert as they are, without a shell splitting
+	// them, so sources with spaces in their paths are fine.
+	var args []string
+
+	// Crop to the rectangle regionRect clipped to the image, so the crop and
+	// the resize below agree on the region's size.
+	if region != image.Rect(0, 0, stats.Width, stats.Height) {
+		args = append(args, "-crop", fmt.Sprintf(
+			"%dx%d+%d+%d",
+			region.Dx(),
+			region.Dy(),
+			region.Min.X,
+			region.Min.Y))
 	}
 
-	switch imgReq.Size.(type) {
-	case SizeFull:
-		break
-	case SizeHeight:
-		resize := imgReq.Size.(SizeHeight)
-		args = fmt.Sprintf(
-			"%s -resize x%d",
-			args,
-			resize.Height,
-		)
-	case SizeWidth:
-		resize := imgReq.Size.(SizeWidth)
-		args = fmt.Sprintf(
-			"%s -resize %dx",
-			args,
-			resize.Width,
-		)
-	case SizeExact:
-		resize := imgReq.Size.(SizeExact)
-		args = fmt.Sprintf(
-			"%s -resize %dx%d!",
-			args,
-			resize.Width,
-			resize.Height,
-		)
-	case SizePercent:
-		resize := imgReq.Size.(SizePercent)
-		args = fmt.Sprintf(
-			"%s -resize %%%f",
-			args,
-			resize.Percent,
-		)
-	case SizeBestFit:
-		resize := imgReq.Size.(SizeBestFit)
-		args = fmt.Sprintf(
-			"%s -resize %dx%d",
-			args,
-			resize.Width,
-			resize.Height,
-		)
-	default:
-		return "", fmt.Errorf("Unrecognized size type: %v\n", imgReq.Size)
+	// scaledSize already worked out the exact output size, so ask for that
+	// rather than re-deriving it from the request.  Tiles at scale factor 1
+	// come out the same size as their region and skip the resample.
+	if out != regionWH {
+		args = append(args, "-resize", fmt.Sprintf("%dx%d!", out.Width, out.Height))
 	}
 
 	switch imgReq.Rotation.(type) {
 	case RotateStandard:
 		rotation := imgReq.Rotation.(RotateStandard)
 		if rotation.Degrees != 0 {
-			args = fmt.Sprintf(
-				"%s -rotate %f",
-				args,
-				rotation.Degrees,
-			)
+			args = append(args, "-rotate", fmt.Sprintf("%f", rotation.Degrees))
 		}
 	case RotateMirrored:
 		rotation := imgReq.Rotation.(RotateMirrored)
-		args = fmt.Sprintf(
-			"%s -flop -rotate %f",
-			args,
-			rotation.Degrees,
-		)
+		args = append(args, "-flop", "-rotate", fmt.Sprintf("%f", rotation.Degrees))
 	default:
-		return "", fmt.Errorf("Unrecognized rotation : %v\n", imgReq.Rotation)
+		return nil, fmt.Errorf("Unrecognized rotation : %v\n", imgReq.Rotation)
 	}
 
 	switch imgReq.Quality {
@@ -512,110 +853,224 @@ func (imgReq ImageReq) buildArgs() (string, error) {
 	case "color":
 		break
 	case "gray":
-		args = fmt.Sprintf(
-			"%s -colorspace Gray",
-			args,
-		)
+		args = append(args, "-colorspace", "Gray")
 	case "bitonal":
-		args = fmt.Sprintf(
-			"%s -colorspace Gray -type Bilevel",
-			args,
-		)
+		args = append(args, "-colorspace", "Gray", "-type", "Bilevel")
 	default:
-		return "", fmt.Errorf("Unrecognized Quality : %v\n", imgReq.Quality)
+		return nil, fmt.Errorf("Unrecognized Quality : %v\n", imgReq.Quality)
 	}
 
 	if convertMemLimit != "" {
-		args = fmt.Sprintf("%s -limit memory %s", args, convertMemLimit)
+		args = append(args, "-limit", "memory", convertMemLimit)
 	}
 
 	// Output to stdout.
-	args = fmt.Sprintf("%s %s %s:-", args, imgReq.toPath(), imgReq.Format)
+	args = append(args, src, imgReq.Format+":-")
 
 	return args, nil
 }
 
+// geometry resolves the request against the image's dimensions: the part
+// of the image it covers and the size that's rendered at.
+func (imgReq ImageReq) geometry(stats WidthHeight) (image.Rectangle, WidthHeight, error) {
+	region, err := regionRect(imgReq.Region, stats)
+	if err != nil {
+		return image.ZR, WidthHeight{}, badRequest("region", err)
+	}
+	out, err := imgReq.outputFor(WidthHeight{Width: region.Dx(), Height: region.Dy()})
+	if err != nil {
+		return image.ZR, WidthHeight{}, badRequest("size", err)
+	}
+	return region, out, nil
+}
+
+// regionRect resolves a RegionXXX struct against the image's dimensions,
+// clipped to the image.
+func regionRect(region interface{}, stats WidthHeight) (image.Rectangle, error) {
+	bounds := image.Rect(0, 0, stats.Width, stats.Height)
+
+	var r image.Rectangle
+	switch region := region.(type) {
+	case RegionFull:
+		return bounds, nil
+	case RegionSquare:
+		side := stats.Width
+		if stats.Height < side {
+			side = stats.Height
+		}
+		x := (stats.Width - side) / 2
+		y := (stats.Height - side) / 2
+		r = image.Rect(x, y, x+side, y+side)
+	case RegionExact:
+		r = image.Rect(
+			region.X,
+			region.Y,
+			farEdge(region.X, region.Width, stats.Width),
+			farEdge(region.Y, region.Height, stats.Height),
+		)
+	case RegionPercent:
+		// Clipped while still floats, so huge percents can't overflow an
+		// int on the way.
+		width, height := float64(stats.Width), float64(stats.Height)
+		x := round(width * region.X / 100.0)
+		y := round(height * region.Y / 100.0)
+		w := round(width * region.Width / 100.0)
+		h := round(height * region.Height / 100.0)
+		r = image.Rect(
+			int(math.Min(x, width)),
+			int(math.Min(y, height)),
+			int(math.Min(x+w, width)),
+			int(math.Min(y+h, height)),
+		)
+	default:
+		return image.ZR, fmt.Errorf("Unrecognized region type: %v", region)
+	}
+
+	// The spec has us return whatever part of the region is on the image.
+	r = r.Intersect(bounds)
+	if r.Empty() {
+		return image.ZR, errors.New(ErrRegionOutsideImage)
+	}
+	return r, nil
+}
+
+// farEdge is offset+length, stopped at limit so that huge regions are
+// clipped to the image rather than overflowing.
+func farEdge(offset, length, limit int) int {
+	if length > limit-offset {
+		return limit
+	}
+	return offset + length
+}
+
+// scaledSize resolves a SizeXXX struct against the dimensions of the
+// (already cropped) region.
+func scaledSize(size interface{}, region WidthHeight) (WidthHeight, error) {
+	w, h := float64(region.Width), float64(region.Height)
+
+	// Worked out as floats and checked before converting, since a percent
+	// or a very thin region can scale past anything an int holds.
+	var outW, outH float64
+	switch size := size.(type) {
+	case SizeFull, SizeMax:
+		outW, outH = w, h
+	case SizeWidth:
+		outW, outH = float64(size.Width), round(h*float64(size.Width)/w)
+	case SizeHeight:
+		outW, outH = round(w*float64(size.Height)/h), float64(size.Height)
+	case SizePercent:
+		outW, outH = round(w*size.Percent/100.0), round(h*size.Percent/100.0)
+	case SizeExact:
+		outW, outH = float64(size.Width), float64(size.Height)
+	case SizeBestFit:
+		scale := math.Min(float64(size.Width)/w, float64(size.Height)/h)
+		outW, outH = round(w*scale), round(h*scale)
+	default:
+		return WidthHeight{}, fmt.Errorf("Unrecognized size type: %v", size)
+	}
+	if !(outW <= maxDimension && outH <= maxDimension) {
+		return WidthHeight{}, errors.New(ErrDimensionTooLarge)
+	}
+
+	out := WidthHeight{Width: int(outW), Height: int(outH)}
+	if out.Width < 1 {
+		out.Width = 1
+	}
+	if out.Height < 1 {
+		out.Height = 1
+	}
+	return out, nil
+}
+
+// outputFor is the size the request renders the (already cropped) region
+// at, once the limits and the version's upscaling rules are applied.
+func (imgReq ImageReq) outputFor(region WidthHeight) (WidthHeight, error) {
+	out, err := scaledSize(imgReq.Size, region)
+	if err != nil {
+		return WidthHeight{}, err
+	}
+
+	switch imgReq.Size.(type) {
+	case SizeMax:
+		out = imgReq.Limits.capped(imgReq.MaxPixels).fit(region, imgReq.Upscale)
+	case SizeFull:
+		// 2.x's full is the whole region, but a server that can't render
+		// that many pixels gives the most it can, as max would.
+		out = SizeLimits{}.capped(imgReq.MaxPixels).fit(region, false)
+	case SizeBestFit:
+		// 3.0's !w,h is "as large as possible" but never bigger than the
+		// region without ^.
+		if imgReq.Version >= 3 && !imgReq.Upscale &&
+			(out.Width > region.Width || out.Height > region.Height) {
+			out = region
+		}
+	}
+
+	if imgReq.Version >= 3 && !imgReq.Upscale &&
+		(out.Width > region.Width || out.Height > region.Height) {
+		return WidthHeight{}, errors.New(ErrUpscaleNotAllowed)
+	}
+	return out, nil
+}
+
 //////////////
 // Parsing  //
 //////////////
-func infoReq(r *http.Request) InfoReq {
+func infoReq(r *http.Request) (InfoReq, error) {
 	vars := mux.Vars(r)
-	prefix, ok := vars["prefix"]
-	if !ok {
-		log.Panicln("Failed to parse prefix from URL")
-	}
+	prefix := vars["prefix"]
 
-	identifier, ok := vars["identifier"]
+	rawIdentifier, ok := vars["identifier"]
 	if !ok {
-		log.Panicln("Failed to parse identifier from URL")
+		return InfoReq{}, badRequest("identifier", errors.New("Failed to parse identifier from URL"))
+	}
+	identifier, err := parseIdentifier(rawIdentifier)
+	if err != nil {
+		return InfoReq{}, badRequest("identifier", err)
 	}
 
 	return InfoReq{
 		Req:        r,
 		Prefix:     prefix,
-		Identifier: identifier,
-	}
+		Identifier: *identifier,
+	}, nil
 }
 
 func imageReq(r *http.Request) (ImageReq, error) {
 	vars := mux.Vars(r)
-	prefix, ok := vars["prefix"]
-	if !ok {
-		return ImageReq{}, errors.New("Failed to parse prefix from URL")
-	}
+	prefix := vars["prefix"]
 
-	rawIdentifier, ok := vars["identifier"]
-	if !ok {
-		return ImageReq{}, errors.New("Failed to parse identifier from URL")
-	}
-	identifier, err := parseIdentifier(rawIdentifier)
+	// The router only matches when all of these are present.
+	identifier, err := parseIdentifier(vars["identifier"])
 	if err != nil {
-		return ImageReq{}, errors.New("Failed to parse identifier (parseIdentifier)")
+		return ImageReq{}, badRequest("identifier", err)
 	}
 
-	rawRegion, ok := vars["region"]
-	if !ok {
-		return ImageReq{}, errors.New("Failed to parse region from URL")
-	}
-	region, err := parseRegion(rawRegion)
+	region, err := parseRegion(vars["region"])
 	if err != nil {
-		return ImageReq{}, errors.New("Failed to parse region (parseRegion)")
+		return ImageReq{}, badRequest("region", err)
 	}
 
-	rawSize, ok := vars["size"]
-	if !ok {
-		return ImageReq{}, errors.New("Failed to parse size from URL")
-	}
-	size, err := parseSize(rawSize)
+	rawSize := vars["size"]
+	upscale := strings.HasPrefix(rawSize, "^")
+	size, err := parseSize(strings.TrimPrefix(rawSize, "^"))
 	if err != nil {
-		return ImageReq{}, errors.New("Failed to parse size (parseSize)")
+		return ImageReq{}, badRequest("size", err)
 	}
 
-	rawRotation, ok := vars["rotation"]
-	if !ok {
-		return ImageReq{}, errors.New("Failed to parse rotation from URL")
-	}
-	rotation, err := parseRotation(rawRotation)
+	rotation, err := parseRotation(vars["rotation"])
 	if err != nil {
-		return ImageReq{}, err
+		return ImageReq{}, badRequest("rotation", err)
 	}
 
-	rawQuality, ok := vars["quality"]
-	if !ok {
-		return ImageReq{}, errors.New("Failed to parse quality from URL")
-	}
-	quality, err := parseQuality(rawQuality)
+	quality, err := parseQuality(vars["quality"])
 	if err != nil {
-		return ImageReq{}, err
+		return ImageReq{}, badRequest("quality", err)
 	}
 
-	rawFormat, ok := vars["format"]
-	if !ok {
-		return ImageReq{}, errors.New("Failed to parse format from URL")
-	}
-	format, err := parseFormat(rawFormat)
+	format, err := parseFormat(vars["format"])
 	if err != nil {
-		return ImageReq{}, err
+		return ImageReq{}, badRequest("format", err)
 	}
 
 	return ImageReq{
@@ -624,15 +1079,29 @@ func imageReq(r *http.Request) (ImageReq, error) {
 		Identifier: *identifier,
 		Region:     region,
 		Size:       size,
+		Upscale:    upscale,
 		Rotation:   rotation,
 		Quality:    *quality,
 		Format:     *format,
 	}, nil
 }
 
-func parseIdentifier(identifier string) (*string, error) {
-	if strings.ContainsAny(identifier, "/?#[]@%") {
-		return nil, errors.New("identifier contains illegal characters")
+// parseIdentifier unescapes a raw identifier from the URL.  Escaped slashes
+// are allowed so identifiers can name nested paths, but not empty, "." or
+// ".." segments.
+func parseIdentifier(rawIdentifier string) (*string, error) {
+	identifier, err := url.PathUnescape(rawIdentifier)
+	if err != nil {
+		return nil, errors.New(ErrInvalidIdentifier)
+	}
+
+	if strings.ContainsAny(identifier, "?#[]@%\\") {
+		return nil, errors.New(ErrInvalidIdentifier)
+	}
+	for _, segment := range strings.Split(identifier, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, errors.New(ErrInvalidIdentifier)
+		}
 	}
 	return &identifier, nil
 }
@@ -642,19 +1111,29 @@ func parseRegion(region string) (interface{}, error) {
 		return RegionFull{}, nil
 	}
 
+	if region == "square" {
+		return RegionSquare{}, nil
+	}
+
 	if strings.HasPrefix(region, "pct:") {
 		parts := strings.Split(region[4:], ",")
+		if len(parts) != 4 {
+			return nil, errors.New(ErrCouldNotParseRegion)
+		}
 		floats := make([]float64, 4)
 		for i, p := range parts {
 			if p == "" {
 				return nil, errors.New(ErrCouldNotParseRegion)
 			}
 			pFloat, err := strconv.ParseFloat(p, 64)
-			if err != nil {
+			if err != nil || !finite(pFloat) {
 				return nil, errors.New(ErrCouldNotParseRegion)
 			}
 			floats[i] = pFloat
 		}
+		if floats[0] < 0 || floats[1] < 0 || floats[2] <= 0 || floats[3] <= 0 {
+			return nil, errors.New(ErrRegionNotPositive)
+		}
 
 		return RegionPercent{
 			X:      floats[0],
@@ -666,6 +1145,9 @@ func parseRegion(region string) (interface{}, error) {
 
 	if strings.Contains(region, ",") {
 		parts := strings.Split(region, ",")
+		if len(parts) != 4 {
+			return nil, errors.New(ErrCouldNotParseRegion)
+		}
 		ints := make([]int, 4)
 		for i, p := range parts {
 			if p == "" {
@@ -677,6 +1159,9 @@ func parseRegion(region string) (interface{}, error) {
 			}
 			ints[i] = int(pInt)
 		}
+		if ints[0] < 0 || ints[1] < 0 || ints[2] <= 0 || ints[3] <= 0 {
+			return nil, errors.New(ErrRegionNotPositive)
+		}
 
 		return RegionExact{
 			X:      ints[0],
@@ -696,6 +1181,11 @@ func parseSize(size string) (interface{}, error) {
 		return SizeFull{}, nil
 	}
 
+	// Max, which 2.1 added and which replaces full in 3.0
+	if size == "max" {
+		return SizeMax{}, nil
+	}
+
 	// Percent
 	if strings.HasPrefix(size, "pct:") {
 		parts := strings.Split(size, ":")
@@ -704,9 +1194,16 @@ func parseSize(size string) (interface{}, error) {
 		}
 
 		pct, err := strconv.ParseFloat(parts[1], 64)
-		if err != nil {
+		if err != nil || !finite(pct) {
 			return nil, errors.New(ErrCouldNotParseSize)
 		}
+		if pct <= 0 {
+			return nil, errors.New(ErrSizeNotPositive)
+		}
+		// Even a one pixel region can't be scaled this far.
+		if pct > 100*maxDimension {
+			return nil, errors.New(ErrDimensionTooLarge)
+		}
 
 		return SizePercent{Percent: pct}, nil
 	}
@@ -746,6 +1243,12 @@ func parseSize(size string) (interface{}, error) {
 			if err != nil {
 				return nil, errors.New(ErrCouldNotWidthHeight)
 			}
+			if width <= 0 {
+				return nil, errors.New(ErrSizeNotPositive)
+			}
+			if width > maxDimension {
+				return nil, errors.New(ErrDimensionTooLarge)
+			}
 			return SizeWidth{Width: width}, nil
 		}
 
@@ -755,6 +1258,12 @@ func parseSize(size string) (interface{}, error) {
 			if err != nil {
 				return nil, errors.New(ErrCouldNotWidthHeight)
 			}
+			if height <= 0 {
+				return nil, errors.New(ErrSizeNotPositive)
+			}
+			if height > maxDimension {
+				return nil, errors.New(ErrDimensionTooLarge)
+			}
 			return SizeHeight{Height: height}, nil
 		}
 	}
@@ -778,7 +1287,9 @@ func parseRotation(rotation string) (interface{}, error) {
 		return nil, errors.New(ErrCouldNotParseRotation)
 	}
 
-	if degrees > 360 || degrees < 0 {
+	// Written this way round so NaN, which compares false with everything,
+	// is out of range too.
+	if !(degrees >= 0 && degrees <= 360) {
 		return nil, errors.New(ErrDegreesOutOfRange)
 	}
 
@@ -837,6 +1348,13 @@ func parseWidthHeight(size string) (WidthHeight, error) {
 		return WidthHeight{}, errors.New(ErrCouldNotWidthHeight)
 	}
 
+	if w <= 0 || h <= 0 {
+		return WidthHeight{}, errors.New(ErrSizeNotPositive)
+	}
+	if w > maxDimension || h > maxDimension {
+		return WidthHeight{}, errors.New(ErrDimensionTooLarge)
+	}
+
 	return WidthHeight{
 		Width:  w,
 		Height: h,
@@ -845,6 +1363,21 @@ func parseWidthHeight(size string) (WidthHeight, error) {
 
 // rand utils
 
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// finite reports whether f is neither NaN nor infinite, which ParseFloat
+// accepts.
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
 // are you kidding me golang
 func round(a float64) float64 {
 	if a < 0 {
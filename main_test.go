@@ -1,6 +1,17 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"image"
+	_ "image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestParseSize(t *testing.T) {
 	t.Parallel()
@@ -10,6 +21,7 @@ func TestParseSize(t *testing.T) {
 		output interface{}
 	}{
 		{"full", SizeFull{}},
+		{"max", SizeMax{}},
 		{"pct:10", SizePercent{Percent: 10}},
 		{"20,", SizeWidth{Width: 20}},
 		{",30", SizeHeight{Height: 30}},
@@ -36,6 +48,7 @@ func TestParseRegion(t *testing.T) {
 		output interface{}
 	}{
 		{"full", RegionFull{}},
+		{"square", RegionSquare{}},
 		{"10,20,30,40", RegionExact{X: 10, Y: 20, Width: 30, Height: 40}},
 		{"pct:50,60.1,70.2,80.3",
 			RegionPercent{
@@ -90,3 +103,318 @@ func TestParseQuality(t *testing.T) {
 func TestParseFormta(t *testing.T) {
 	t.Parallel()
 }
+
+func TestParseIdentifier(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		identifier string
+		output     string
+	}{
+		{"abundance", "abundance"},
+		{"books%2Fvol1%2Fp001", "books/vol1/p001"},
+		{"with%20space", "with space"},
+	}
+
+	for _, test := range tests {
+		o, err := parseIdentifier(test.identifier)
+		if err != nil {
+			t.Errorf("Unexpected error parsing identifier: %s\n", test.identifier)
+			continue
+		}
+		if *o != test.output {
+			t.Errorf("expected %v, got: %v\n", test.output, *o)
+		}
+	}
+
+	for _, bad := range []string{"..%2Fetc%2Fpasswd", "a%2F%2Fb", "%2Fabs", "a%3Fb", "%zz"} {
+		_, err := parseIdentifier(bad)
+		if err == nil || err.Error() != ErrInvalidIdentifier {
+			t.Errorf("Expected ErrInvalidIdentifier for %s", bad)
+		}
+	}
+}
+
+func TestRegionSquare(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		stats    WidthHeight
+		expected image.Rectangle
+	}{
+		{WidthHeight{300, 200}, image.Rect(50, 0, 250, 200)},
+		{WidthHeight{131, 175}, image.Rect(0, 22, 131, 153)},
+		{WidthHeight{64, 64}, image.Rect(0, 0, 64, 64)},
+	}
+
+	for _, test := range tests {
+		r, err := regionRect(RegionSquare{}, test.stats)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %s", test.stats, err)
+		}
+		if r != test.expected {
+			t.Errorf("expected %v for %v, got: %v", test.expected, test.stats, r)
+		}
+	}
+}
+
+func TestSquareThumbnails(t *testing.T) {
+	t.Parallel()
+
+	router := newRouter(testContext(t, []*Collection{{
+		Resolver:   ResolverConfig{Root: "images"},
+		Cache:      CachePolicy{Disabled: true},
+		SizeLimits: SizeLimits{MaxWidth: 250},
+	}}))
+
+	tests := []struct {
+		path   string
+		width  int
+		height int
+	}{
+		{"/sample2/square/150,/0/default.png", 150, 150},
+		{"/sample2/square/max/0/default.png", 200, 200},
+		// max shrinks to fit maxWidth.
+		{"/sample2/full/max/0/default.png", 250, 167},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200 for %s, got: %d", test.path, w.Code)
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(w.Body)
+		if err != nil {
+			t.Errorf("Unexpected error decoding %s: %s", test.path, err)
+			continue
+		}
+		if cfg.Width != test.width || cfg.Height != test.height {
+			t.Errorf("expected %dx%d for %s, got: %dx%d",
+				test.width, test.height, test.path, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestParseRejectsEmptyRegionsAndSizes(t *testing.T) {
+	t.Parallel()
+
+	for _, region := range []string{
+		"0,0,0,10", "0,0,10,-1", "-1,0,10,10", "pct:0,0,0,50", "pct:-5,0,10,10",
+		"1,2,3", "1,2,3,4,5", "pct:1,2,3,4,5", "pct:NaN,0,10,10", "pct:0,0,Inf,10",
+	} {
+		if _, err := parseRegion(region); err == nil {
+			t.Errorf("expected an error for region %s", region)
+		}
+	}
+
+	for _, size := range []string{
+		"0,", ",0", "-5,", "0,10", "10,-1", "!0,10", "pct:0", "pct:-1",
+		"4294967296,", ",4294967296", "4294967296,4294967296", "!10,4294967296",
+		"pct:1e300", "pct:NaN", "pct:Inf",
+	} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("expected an error for size %s", size)
+		}
+	}
+}
+
+func TestParseRejectsNonFinite(t *testing.T) {
+	t.Parallel()
+
+	for _, rotation := range []string{"NaN", "!NaN", "Inf", "-Inf", "!+Inf"} {
+		if _, err := parseRotation(rotation); err == nil {
+			t.Errorf("expected an error for rotation %s", rotation)
+		}
+	}
+	for _, region := range []string{"pct:NaN,0,10,10", "pct:0,0,Inf,10", "pct:0,0,10,+Inf"} {
+		if _, err := parseRegion(region); err == nil {
+			t.Errorf("expected an error for region %s", region)
+		}
+	}
+	for _, size := range []string{"pct:NaN", "pct:Inf"} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("expected an error for size %s", size)
+		}
+	}
+
+	// These used to reach the go processor's rotate and crash the server.
+	router := newRouter(testContext(t, []*Collection{
+		{Resolver: ResolverConfig{Root: "images"}, Cache: CachePolicy{Disabled: true}},
+	}))
+	for _, path := range []string{
+		"/sample2/full/50,/NaN/default.png",
+		"/sample2/full/50,/!NaN/default.png",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got: %d", path, w.Code)
+		}
+	}
+}
+
+func TestRegionClipping(t *testing.T) {
+	t.Parallel()
+
+	stats := WidthHeight{300, 200}
+	tests := []struct {
+		region   interface{}
+		expected image.Rectangle
+		err      bool
+	}{
+		{RegionExact{X: 250, Y: 150, Width: 100, Height: 100}, image.Rect(250, 150, 300, 200), false},
+		{RegionExact{X: 300, Y: 0, Width: 10, Height: 10}, image.ZR, true},
+		{RegionExact{X: 0, Y: 500, Width: 10, Height: 10}, image.ZR, true},
+		{RegionPercent{X: 50, Y: 50, Width: 150, Height: 150}, image.Rect(150, 100, 300, 200), false},
+		{RegionPercent{X: 100, Y: 0, Width: 10, Height: 10}, image.ZR, true},
+		{RegionExact{X: 10, Y: 0, Width: math.MaxInt64, Height: 10}, image.Rect(10, 0, 300, 10), false},
+		{RegionExact{X: 0, Y: 10, Width: 10, Height: math.MaxInt64}, image.Rect(0, 10, 10, 200), false},
+		{RegionExact{X: math.MaxInt64, Y: 0, Width: math.MaxInt64, Height: 10}, image.ZR, true},
+		{RegionPercent{X: 0, Y: 0, Width: 1e30, Height: 1e30}, image.Rect(0, 0, 300, 200), false},
+		{RegionPercent{X: 50, Y: 0, Width: 1e300, Height: 10}, image.Rect(150, 0, 300, 20), false},
+		{RegionPercent{X: 1e30, Y: 0, Width: 10, Height: 10}, image.ZR, true},
+	}
+
+	for _, test := range tests {
+		r, err := regionRect(test.region, stats)
+		if (err != nil) != test.err {
+			t.Errorf("expected error=%v for %v, got: %v", test.err, test.region, err)
+			continue
+		}
+		if r != test.expected {
+			t.Errorf("expected %v for %v, got: %v", test.expected, test.region, r)
+		}
+	}
+}
+
+func TestPixelCap(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{
+		{Resolver: ResolverConfig{Root: "images"}, Cache: CachePolicy{Disabled: true}},
+		{Prefix: "three", Resolver: ResolverConfig{Root: "images"}, Cache: CachePolicy{Disabled: true},
+			Version: 3},
+	})
+	ctx.config.Load().MaxPixels = 100 * 100
+	router := newRouter(ctx)
+
+	// sample2 is 300x200, so the most the cap allows is 122x81.
+	capped := image.Rect(0, 0, 122, 81)
+	tests := []struct {
+		path   string
+		status int
+		bounds image.Rectangle
+	}{
+		{"/sample2/full/99999,99999/0/default.png", http.StatusRequestEntityTooLarge, image.ZR},
+		{"/sample2/full/300,/0/default.png", http.StatusRequestEntityTooLarge, image.ZR},
+		{"/sample2/full/4294967296,4294967296/0/default.png", http.StatusBadRequest, image.ZR},
+		{"/sample2/full/!4294967296,4294967296/0/default.png", http.StatusBadRequest, image.ZR},
+		{"/sample2/full/pct:1e300/0/default.png", http.StatusBadRequest, image.ZR},
+		{"/sample2/full/pct:NaN/0/default.png", http.StatusBadRequest, image.ZR},
+		{"/sample2/0,0,1,200/16000000,/0/default.png", http.StatusBadRequest, image.ZR},
+		{"/sample2/pct:0,0,1e30,1e30/100,/0/default.png", http.StatusOK, image.Rect(0, 0, 100, 67)},
+		{"/sample2/full/full/0/default.png", http.StatusOK, capped},
+		{"/sample2/full/max/0/default.png", http.StatusOK, capped},
+		{"/three/sample2/full/max/0/default.png", http.StatusOK, capped},
+		{"/sample2/full/100,/0/default.png", http.StatusOK, image.Rect(0, 0, 100, 67)},
+		{"/sample2/250,150,100,100/full/0/default.png", http.StatusOK, image.Rect(0, 0, 50, 50)},
+		{"/sample2/300,0,10,10/full/0/default.png", http.StatusBadRequest, image.ZR},
+		{"/sample2/290,0,9223372036854775807,10/full/0/default.png", http.StatusOK, image.Rect(0, 0, 10, 10)},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("expected %d for %s, got: %d", test.status, test.path, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		config, _, err := image.DecodeConfig(w.Body)
+		if err != nil {
+			t.Errorf("Unexpected error decoding %s: %s", test.path, err)
+			continue
+		}
+		if bounds := image.Rect(0, 0, config.Width, config.Height); bounds != test.bounds {
+			t.Errorf("expected %v for %s, got: %v", test.bounds, test.path, bounds)
+		}
+	}
+
+	// info.json only offers what the cap allows.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/three/sample2/info.json", nil))
+	var info ImageInfo3
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Unexpected error decoding info.json: %s", err)
+	}
+	if info.MaxArea != 100*100 {
+		t.Errorf("expected maxArea to be the cap, got: %d", info.MaxArea)
+	}
+	for _, size := range info.Sizes {
+		if size.Width*size.Height > 100*100 {
+			t.Errorf("expected sizes within the cap, got: %v", info.Sizes)
+		}
+	}
+	for _, tile := range info.Tiles {
+		if tile.Width*tile.Width > 100*100 {
+			t.Errorf("expected tiles within the cap, got: %v", info.Tiles)
+		}
+	}
+}
+
+func TestBuildArgs(t *testing.T) {
+	t.Parallel()
+
+	imgReq := ImageReq{
+		Region:   RegionExact{X: 10, Y: 20, Width: 100, Height: 50},
+		Size:     SizeWidth{Width: 50},
+		Rotation: RotateStandard{Degrees: 90},
+		Format:   "png",
+		Quality:  "gray",
+		Stats:    WidthHeight{Width: 400, Height: 300},
+	}
+	args, err := imgReq.buildArgs(context.Background(), "/srv/images/folio 1r.tif", "256MiB")
+	if err != nil {
+		t.Fatalf("Unexpected error building args: %s", err)
+	}
+	expected := []string{
+		"-crop", "100x50+10+20",
+		"-resize", "50x25!",
+		"-rotate", "90.000000",
+		"-colorspace", "Gray",
+		"-limit", "memory", "256MiB",
+		"/srv/images/folio 1r.tif", "png:-",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %q, got: %q", expected, args)
+	}
+}
+
+// stallingProcessor never finishes identifying, until it's cancelled.
+type stallingProcessor struct {
+	GoProcessor
+}
+
+func (stallingProcessor) Identify(ctx context.Context, src string) (ImageMetadata, error) {
+	<-ctx.Done()
+	return ImageMetadata{}, ctx.Err()
+}
+
+func TestInfoTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{
+		{Resolver: ResolverConfig{Root: "images"}, Cache: CachePolicy{Disabled: true}},
+	})
+	cfg := ctx.config.Load()
+	cfg.processor = stallingProcessor{}
+	cfg.RenderTimeout = Duration{50 * time.Millisecond}
+
+	w := httptest.NewRecorder()
+	newRouter(ctx).ServeHTTP(w, httptest.NewRequest("GET", "/sample2/info.json", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ImageMetadata is what we know about a source image without decoding it.
+type ImageMetadata struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Format is as the processor names it, e.g. PNG or jpegload.
+	Format     string `json:"format"`
+	ColorSpace string `json:"colorSpace,omitempty"`
+	// BitDepth is per channel.
+	BitDepth int  `json:"bitDepth,omitempty"`
+	Pages    int  `json:"pages"`
+	HasICC   bool `json:"hasICC"`
+	// ModTime and Size are the source's when this was read, so we can tell
+	// when it's out of date.
+	ModTime time.Time `json:"modTime"`
+	Size    int64     `json:"size"`
+}
+
+// Dimensions .
+func (m ImageMetadata) Dimensions() WidthHeight {
+	return WidthHeight{Width: m.Width, Height: m.Height}
+}
+
+// describes reports whether m was read from the version of the source
+// that src is.
+func (m ImageMetadata) describes(src *Source) bool {
+	return m.ModTime.Equal(src.ModTime) && m.Size == src.Size
+}
+
+// MetadataStore remembers ImageMetadata so we only identify each version of
+// a source once, rather than on every info.json and every render.  Entries
+// are kept in memory and, if it has a directory, as JSON sidecars there, so
+// they survive a restart.  They're looked up lazily, or up front by
+// iiif-server warm.
+//
+// Only the maxMetadataEntries most recently used are kept in memory; the
+// rest are read back from their sidecars when they're next looked up.
+type MetadataStore struct {
+	dir string
+
+	mu sync.Mutex
+	// index orders the ids in entries by use.  Each counts as one byte, so
+	// its maxBytes is the number of entries kept.
+	index   *lru
+	entries map[string]ImageMetadata
+}
+
+// maxMetadataEntries bounds the metadata a MetadataStore keeps in memory.
+// An entry is a couple of hundred bytes, so this is tens of megabytes.
+const maxMetadataEntries = 100 * 1000
+
+// NewMetadataStore keeps sidecars in dir, or only keeps metadata in memory
+// if dir is "".
+func NewMetadataStore(dir string) (*MetadataStore, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+			return nil, err
+		}
+	}
+	return &MetadataStore{
+		dir:     dir,
+		index:   newLRU(maxMetadataEntries, 0),
+		entries: make(map[string]ImageMetadata),
+	}, nil
+}
+
+// Lookup returns the metadata for src, served under prefix, identifying it
+// with processor if we don't have it for this version of the source.
+func (s *MetadataStore) Lookup(
+	ctx context.Context,
+	prefix string,
+	src *Source,
+	processor Processor,
+) (ImageMetadata, error) {
+	id := sourceTag(prefix, src).ID
+
+	s.mu.Lock()
+	meta, ok := s.entries[id]
+	if ok {
+		s.index.get(id, "", time.Time{})
+	}
+	s.mu.Unlock()
+	if ok && meta.describes(src) {
+		return meta, nil
+	}
+
+	if meta, err := s.readSidecar(id); err == nil && meta.describes(src) {
+		s.remember(id, meta)
+		return meta, nil
+	}
+
+	identifies.Inc(processor.Name())
+	meta, err := processor.Identify(ctx, src.Path)
+	if err != nil {
+		return ImageMetadata{}, err
+	}
+	meta.ModTime, meta.Size = src.ModTime, src.Size
+	s.remember(id, meta)
+	if err := s.writeSidecar(id, meta); err != nil {
+		logrus.Errorf("err writing metadata for %s: %s", id, err)
+	}
+	return meta, nil
+}
+
+// Purge forgets the metadata for the image id, or with prefix set for every
+// image under id, by whole path segments.
+func (s *MetadataStore) Purge(id string, prefix bool) {
+	s.mu.Lock()
+	for _, entry := range s.index.purge(id, prefix) {
+		delete(s.entries, entry.key)
+	}
+	s.mu.Unlock()
+
+	if s.dir == "" {
+		return
+	}
+	if !prefix {
+		os.Remove(s.sidecarPath(id))
+		return
+	}
+	// Sidecars are named by a hash of the id, so finding the ones under a
+	// prefix means reading them all.
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		logrus.Errorf("err purging metadata: %s", err)
+		return
+	}
+	for _, info := range infos {
+		path := filepath.Join(s.dir, info.Name())
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var sidecar metadataSidecar
+		if json.Unmarshal(raw, &sidecar) == nil && underPrefix(sidecar.ID, id) {
+			os.Remove(path)
+		}
+	}
+}
+
+func (s *MetadataStore) remember(id string, meta ImageMetadata) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[id] = meta
+	evicted := s.index.add(&cacheEntry{key: id, tag: CacheTag{ID: id}, size: 1})
+	for _, entry := range evicted {
+		delete(s.entries, entry.key)
+	}
+}
+
+// metadataSidecar is the JSON kept for each image.  The id is there for
+// purging by prefix.
+type metadataSidecar struct {
+	ID string `json:"id"`
+	ImageMetadata
+}
+
+func (s *MetadataStore) sidecarPath(id string) string {
+	return filepath.Join(s.dir, md5str(id)+".json")
+}
+
+func (s *MetadataStore) readSidecar(id string) (ImageMetadata, error) {
+	if s.dir == "" {
+		return ImageMetadata{}, errors.New("no metadata dir")
+	}
+	raw, err := ioutil.ReadFile(s.sidecarPath(id))
+	if err != nil {
+		return ImageMetadata{}, err
+	}
+	var sidecar metadataSidecar
+	if err := json.Unmarshal(raw, &sidecar); err != nil {
+		return ImageMetadata{}, err
+	}
+	if sidecar.ID != id {
+		return ImageMetadata{}, fmt.Errorf("sidecar is for %s", sidecar.ID)
+	}
+	return sidecar.ImageMetadata, nil
+}
+
+// writeSidecar writes atomically, like DiskCache, so a crash can't leave a
+// sidecar half written.
+func (s *MetadataStore) writeSidecar(id string, meta ImageMetadata) error {
+	if s.dir == "" {
+		return nil
+	}
+	raw, err := json.Marshal(metadataSidecar{ID: id, ImageMetadata: meta})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(raw)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), os.FileMode(0644))
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.sidecarPath(id))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// identifyFormat has identify print, for each frame,
+// width|height|format|colorspace|depth|frames|profiles
+const identifyFormat = "%w|%h|%m|%[colorspace]|%z|%n|%[profiles]\n"
+
+// parseIdentify reads the first frame's line of identifyFormat output.
+func parseIdentify(out string) (ImageMetadata, error) {
+	line := strings.SplitN(strings.TrimSpace(out), "\n", 2)[0]
+	fields := strings.Split(line, "|")
+	if len(fields) != 7 {
+		return ImageMetadata{}, fmt.Errorf("couldn't parse identify output: %q", out)
+	}
+
+	wh, err := parseWidthHeight(fields[0] + "," + fields[1])
+	if err != nil {
+		return ImageMetadata{}, err
+	}
+	depth, _ := strconv.Atoi(fields[4])
+	pages, _ := strconv.Atoi(fields[5])
+	if pages < 1 {
+		pages = 1
+	}
+	profiles := strings.ToLower(fields[6])
+	return ImageMetadata{
+		Width:      wh.Width,
+		Height:     wh.Height,
+		Format:     fields[2],
+		ColorSpace: strings.ToLower(fields[3]),
+		BitDepth:   depth,
+		Pages:      pages,
+		HasICC:     strings.Contains(profiles, "icc") || strings.Contains(profiles, "icm"),
+	}, nil
+}
+
+// vipsBitDepths maps vipsheader's band formats to bits per channel.
+var vipsBitDepths = map[string]int{
+	"uchar": 8, "char": 8,
+	"ushort": 16, "short": 16,
+	"uint": 32, "int": 32, "float": 32,
+	"double": 64,
+}
+
+// parseVipsHeader reads the output of vipsheader -a, which is a line of
+// "field: value" for each header field.
+func parseVipsHeader(out string) (ImageMetadata, error) {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	w, errW := strconv.Atoi(fields["width"])
+	h, errH := strconv.Atoi(fields["height"])
+	if errW != nil || errH != nil || w < 1 || h < 1 {
+		return ImageMetadata{}, fmt.Errorf("couldn't parse vipsheader output: %q", out)
+	}
+	pages, err := strconv.Atoi(fields["n-pages"])
+	if err != nil || pages < 1 {
+		pages = 1
+	}
+	_, hasICC := fields["icc-profile-data"]
+	return ImageMetadata{
+		Width:      w,
+		Height:     h,
+		Format:     fields["vips-loader"],
+		ColorSpace: fields["interpretation"],
+		BitDepth:   vipsBitDepths[fields["format"]],
+		Pages:      pages,
+		HasICC:     hasICC,
+	}, nil
+}
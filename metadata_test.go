@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingProcessor counts how often sources are identified.
+type countingProcessor struct {
+	GoProcessor
+	identified *int32
+}
+
+func (p countingProcessor) Identify(ctx context.Context, src string) (ImageMetadata, error) {
+	atomic.AddInt32(p.identified, 1)
+	return p.GoProcessor.Identify(ctx, src)
+}
+
+func TestParseIdentify(t *testing.T) {
+	t.Parallel()
+
+	meta, err := parseIdentify("4000|2656|JPEG|sRGB|8|1|exif,icc\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := ImageMetadata{
+		Width: 4000, Height: 2656, Format: "JPEG", ColorSpace: "srgb",
+		BitDepth: 8, Pages: 1, HasICC: true,
+	}
+	if meta != expected {
+		t.Errorf("expected %+v, got: %+v", expected, meta)
+	}
+
+	// Multi-page sources print a line per page; the first is the one served.
+	meta, err = parseIdentify("600|800|TIFF|Gray|16|3|\n300|400|TIFF|Gray|16|3|\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if meta.Dimensions() != (WidthHeight{600, 800}) || meta.Pages != 3 || meta.HasICC {
+		t.Errorf("expected the first of 3 pages without a profile, got: %+v", meta)
+	}
+
+	if _, err := parseIdentify("131,175"); err == nil {
+		t.Errorf("expected an error for the wrong format")
+	}
+}
+
+func TestParseVipsHeader(t *testing.T) {
+	t.Parallel()
+
+	meta, err := parseVipsHeader(`big.jpg: 4000x2656 uchar, 3 bands, srgb, jpegload
+width: 4000
+height: 2656
+bands: 3
+format: uchar
+coding: none
+interpretation: srgb
+n-pages: 2
+icc-profile-data: 3144 bytes of binary data
+vips-loader: jpegload
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := ImageMetadata{
+		Width: 4000, Height: 2656, Format: "jpegload", ColorSpace: "srgb",
+		BitDepth: 8, Pages: 2, HasICC: true,
+	}
+	if meta != expected {
+		t.Errorf("expected %+v, got: %+v", expected, meta)
+	}
+
+	if _, err := parseVipsHeader("vips: unable to open"); err == nil {
+		t.Errorf("expected an error without dimensions")
+	}
+}
+
+func TestMetadataStore(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "iiif-metadata")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "scan.png")
+	copySample := func(sample string, mtime time.Time) *Source {
+		data, err := ioutil.ReadFile(filepath.Join("images", sample))
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s: %s", sample, err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Unexpected error writing scan: %s", err)
+		}
+		os.Chtimes(path, mtime, mtime)
+		return &Source{Identifier: "scan", Path: path, ModTime: mtime, Size: int64(len(data))}
+	}
+
+	var identified int32
+	processor := countingProcessor{identified: &identified}
+	sidecars := filepath.Join(dir, "metadata")
+	store, err := NewMetadataStore(sidecars)
+	if err != nil {
+		t.Fatalf("Unexpected error opening store: %s", err)
+	}
+
+	src := copySample("sample.png", time.Now().Add(-time.Hour).Truncate(time.Second))
+	for i := 0; i < 3; i++ {
+		meta, err := store.Lookup(context.Background(), "scans", src, processor)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if meta.Dimensions() != (WidthHeight{131, 175}) {
+			t.Errorf("expected 131x175, got: %v", meta.Dimensions())
+		}
+	}
+	if identified != 1 {
+		t.Errorf("expected one identify, got: %d", identified)
+	}
+
+	// A new store reads what the last one wrote.
+	store, err = NewMetadataStore(sidecars)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening store: %s", err)
+	}
+	if _, err := store.Lookup(context.Background(), "scans", src, processor); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if identified != 1 {
+		t.Errorf("expected the sidecar to be used after a restart, got: %d identifies", identified)
+	}
+
+	// A changed source is identified again.
+	src = copySample("sample2.png", time.Now().Truncate(time.Second))
+	meta, err := store.Lookup(context.Background(), "scans", src, processor)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if identified != 2 || meta.Dimensions() == (WidthHeight{131, 175}) {
+		t.Errorf("expected the replaced source to be identified again, got: %d identifies, %v",
+			identified, meta.Dimensions())
+	}
+
+	// So is a purged one, though not by purging a prefix it only starts
+	// with.
+	store.Purge("scans/sc", true)
+	if entries, _ := ioutil.ReadDir(sidecars); len(entries) != 1 {
+		t.Errorf("expected the sidecar to survive purging a sibling, got: %d files", len(entries))
+	}
+	store.Purge("scans/", true)
+	if entries, _ := ioutil.ReadDir(sidecars); len(entries) != 0 {
+		t.Errorf("expected the sidecar to be purged, got: %d files", len(entries))
+	}
+	store.Lookup(context.Background(), "scans", src, processor)
+	if identified != 3 {
+		t.Errorf("expected a purged source to be identified again, got: %d identifies", identified)
+	}
+}
+
+func TestMetadataStoreBounded(t *testing.T) {
+	t.Parallel()
+
+	var identified int32
+	processor := countingProcessor{identified: &identified}
+	store, err := NewMetadataStore("")
+	if err != nil {
+		t.Fatalf("Unexpected error opening store: %s", err)
+	}
+	store.index.maxBytes = 2
+
+	lookup := func(identifier string) {
+		path := filepath.Join("images", "sample.png")
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		src := &Source{Identifier: identifier, Path: path, ModTime: info.ModTime(), Size: info.Size()}
+		if _, err := store.Lookup(context.Background(), "scans", src, processor); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	lookup("a")
+	lookup("b")
+	lookup("a")
+	lookup("c")
+	if len(store.entries) != 2 {
+		t.Errorf("expected 2 entries in memory, got: %d", len(store.entries))
+	}
+	if identified != 3 {
+		t.Errorf("expected 3 identifies, got: %d", identified)
+	}
+
+	// b was the least recently used, so it's the one that went.
+	lookup("a")
+	lookup("c")
+	if identified != 3 {
+		t.Errorf("expected a and c to still be kept, got: %d identifies", identified)
+	}
+	lookup("b")
+	if identified != 4 {
+		t.Errorf("expected b to be identified again, got: %d identifies", identified)
+	}
+}
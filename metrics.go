@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The metrics are package-wide, as Prometheus expects, since some are
+// counted far from any Context (runCommand, for one).  Gauges that describe
+// a Context's state are read from it when /metrics is scraped.
+var (
+	httpRequests = newMetricVec("counter", "iiif_http_requests_total",
+		"HTTP requests served.", "route", "status", "format")
+	httpDuration = newHistogramVec("iiif_http_request_duration_seconds",
+		"How long HTTP requests took to serve.", latencyBuckets, "route", "status", "format")
+	renderDuration = newHistogramVec("iiif_render_duration_seconds",
+		"How long renders took, by processor and whether they succeeded.",
+		latencyBuckets, "processor", "result")
+	cacheLookups = newMetricVec("counter", "iiif_cache_lookups_total",
+		"Image requests looked up in the render cache.", "result")
+	identifies = newMetricVec("counter", "iiif_identify_total",
+		"Sources identified, rather than found in the metadata store.", "processor")
+	subprocesses = newMetricVec("gauge", "iiif_subprocesses",
+		"Subprocesses running, by command.", "command")
+)
+
+// latencyBuckets run from 5ms to a minute, past the default render timeout.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// metricsCollector is anything that can write itself in Prometheus' text
+// format.
+type metricsCollector interface {
+	write(w io.Writer)
+}
+
+var registry = []metricsCollector{
+	httpRequests, httpDuration, renderDuration, cacheLookups, identifies, subprocesses,
+}
+
+// metricVec is a counter or gauge, split by its labels.
+type metricVec struct {
+	kind   string
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{
+		kind:   kind,
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+// Add adds v to the series with the given label values, in the order the
+// labels were declared.
+func (m *metricVec) Add(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] += v
+}
+
+// Inc .
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set .
+func (m *metricVec) Set(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = v
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeMetaData(w, m.name, m.help, m.kind)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, labelPairs(m.labels, key, ""), formatFloat(m.values[key]))
+	}
+}
+
+// histogramVec is a histogram, split by its labels.
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		labels:  labels,
+		series:  make(map[string]*histogram),
+	}
+}
+
+// Observe records v in the series with the given label values.
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeMetaData(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n",
+				h.name, labelPairs(h.labels, key, formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, key, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, key, ""), s.count)
+	}
+}
+
+// seriesKey joins label values with a byte that can't be in UTF-8 text.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetaData(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelPairs formats the labels of the series key as {a="x",b="y"}, adding
+// le for histogram buckets if it's set.
+func labelPairs(labels []string, key, le string) string {
+	var pairs []string
+	if len(labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(value)))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes label values the way the text format wants.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsHandler serves everything in the registry, and the state of ctx's
+// pool and cache, in Prometheus' text format at /metrics.  It's behind the
+// admin access rules; Prometheus can send a bearer token.
+func metricsHandler(ctx Context, w http.ResponseWriter, r *http.Request) {
+	cfg := ctx.config.Load()
+	if !authorizeAdmin(cfg, w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	for _, c := range registry {
+		c.write(out)
+	}
+
+	pool := newMetricVec("gauge", "iiif_worker_queue_depth", "Renders waiting for a worker.")
+	pool.Set(float64(ctx.pool.QueueDepth()))
+	workers := newMetricVec("gauge", "iiif_workers", "Render workers.")
+	workers.Set(float64(ctx.pool.workers))
+	inFlight := newMetricVec("gauge", "iiif_renders_in_flight",
+		"Cached renders under way, each shared by everyone asking for it.")
+	inFlight.Set(float64(ctx.renders.InFlight()))
+	for _, c := range []metricsCollector{pool, workers, inFlight} {
+		c.write(out)
+	}
+	cacheMetrics(ctx.cache).write(out)
+}
+
+// cacheTiers is the cache's state, by tier.
+type cacheTiers []metricsCollector
+
+func (tiers cacheTiers) write(w io.Writer) {
+	for _, c := range tiers {
+		c.write(w)
+	}
+}
+
+// cacheMetrics reads the size and evictions of each tier of cache.
+func cacheMetrics(cache Cache) metricsCollector {
+	bytes := newMetricVec("gauge", "iiif_cache_bytes", "Size of the cached renders.", "tier")
+	entries := newMetricVec("gauge", "iiif_cache_entries", "Cached renders.", "tier")
+	evictions := newMetricVec("counter", "iiif_cache_evictions_total",
+		"Cached renders pushed out to make room.", "tier")
+	hits := newMetricVec("counter", "iiif_cache_tier_hits_total",
+		"Cache lookups answered by each tier.", "tier")
+	misses := newMetricVec("counter", "iiif_cache_tier_misses_total",
+		"Cache lookups each tier couldn't answer.", "tier")
+
+	tier := func(name string, c Cache) {
+		switch c := c.(type) {
+		case *MemoryCache:
+			bytes.Set(float64(c.Size()), name)
+			entries.Set(float64(c.Len()), name)
+			evictions.Set(float64(c.Evictions()), name)
+		case *DiskCache:
+			bytes.Set(float64(c.Size()), name)
+			entries.Set(float64(c.Len()), name)
+			evictions.Set(float64(c.Evictions()), name)
+		}
+	}
+	switch c := cache.(type) {
+	case *TieredCache:
+		tier("memory", c.memory)
+		tier("disk", c.slow)
+		stats := c.Stats()
+		hits.Set(float64(stats.MemoryHits), "memory")
+		misses.Set(float64(stats.MemoryMisses), "memory")
+		hits.Set(float64(stats.DiskHits), "disk")
+		misses.Set(float64(stats.DiskMisses), "disk")
+		return cacheTiers{bytes, entries, evictions, hits, misses}
+	case *MemoryCache:
+		tier("memory", c)
+	default:
+		tier("disk", c)
+	}
+	return cacheTiers{bytes, entries, evictions}
+}
+
+// instrumentedHandler counts and times the requests router serves.
+type instrumentedHandler struct {
+	router *mux.Router
+}
+
+func instrument(router *mux.Router) http.Handler {
+	return instrumentedHandler{router: router}
+}
+
+// statusRecorder remembers the status a handler sent.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (h instrumentedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Label by route name rather than path, or every image would be its
+	// own series.
+	route, format := "other", ""
+	var match mux.RouteMatch
+	if h.router.Match(r, &match) && match.Route != nil {
+		route = match.Route.GetName()
+		// Only formats we know, so a client can't make a series per
+		// request with made-up extensions.
+		switch format = match.Vars["format"]; {
+		case route == "info":
+			format = "json"
+		case format != "" && !contains(validFormats, format):
+			format = "other"
+		}
+	}
+
+	rec := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	// Deferred so requests that are aborted with a panic are counted too.
+	defer func() {
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := []string{route, strconv.Itoa(status), format}
+		httpRequests.Inc(labels...)
+		httpDuration.Observe(time.Since(start).Seconds(), labels...)
+	}()
+	h.router.ServeHTTP(rec, r)
+}
+
+// observeRender records how long a render by processor took.
+func observeRender(processor string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	renderDuration.Observe(time.Since(start).Seconds(), processor, result)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramFormat(t *testing.T) {
+	t.Parallel()
+
+	h := newHistogramVec("test_seconds", "Test.", []float64{1, 2}, "name")
+	h.Observe(0.5, `a"b\c`)
+	h.Observe(1.5, `a"b\c`)
+	h.Observe(3, `a"b\c`)
+
+	var out bytes.Buffer
+	h.write(&out)
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{name="a\"b\\c",le="1"} 1
+test_seconds_bucket{name="a\"b\\c",le="2"} 2
+test_seconds_bucket{name="a\"b\\c",le="+Inf"} 3
+test_seconds_sum{name="a\"b\\c"} 5
+test_seconds_count{name="a\"b\\c"} 3
+`
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{{Resolver: ResolverConfig{Root: "images"}}})
+	handler := instrument(newRouter(ctx))
+	get := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	for _, path := range []string{
+		"/sample2/full/70,/0/default.png",
+		"/sample2/full/70,/0/default.png",
+		"/sample2/info.json",
+		"/nope/info.json",
+		"/sample2/full/50,/0/default.xyz",
+	} {
+		get(path, "127.0.0.1:1234")
+	}
+
+	if w := get("/metrics", "192.0.2.1:1234"); w.Code != http.StatusForbidden {
+		t.Errorf("expected /metrics to be behind the admin rules, got: %d", w.Code)
+	}
+	w := get("/metrics", "127.0.0.1:1234")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("expected the metrics, got: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// The counters are shared with other tests, so only check that the
+	// series are there.
+	body := w.Body.String()
+	for _, series := range []string{
+		`iiif_http_requests_total{route="image",status="200",format="png"} `,
+		`iiif_http_request_duration_seconds_bucket{route="info",status="200",format="json",le="+Inf"} `,
+		`iiif_http_requests_total{route="info",status="404",format="json"} `,
+		`iiif_http_requests_total{route="image",status="400",format="other"} `,
+		`iiif_render_duration_seconds_count{processor="go",result="ok"} `,
+		`iiif_cache_lookups_total{result="hit"} `,
+		`iiif_cache_lookups_total{result="miss"} `,
+		`iiif_identify_total{processor="go"} `,
+		"# TYPE iiif_subprocesses gauge\n",
+		"iiif_worker_queue_depth 0\n",
+		"iiif_workers 2\n",
+		`iiif_cache_entries{tier="memory"} 1` + "\n",
+		`iiif_cache_evictions_total{tier="memory"} 0` + "\n",
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("expected %q in:\n%s", series, body)
+		}
+	}
+	if strings.Contains(body, `format="xyz"`) {
+		t.Errorf("expected unknown formats to be labelled other, got:\n%s", body)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrQueueFull is returned by Submit when every worker is busy and the
+// queue has no room left.
+var ErrQueueFull = errors.New("worker queue full")
+
+// Job is a single render to be run by the WorkerPool.  Run is passed Ctx
+// and is expected to give up when it's done; the job is skipped entirely if
+// Ctx is already done by the time a worker gets to it.
+type Job struct {
+	Ctx      context.Context
+	Run      func(ctx context.Context) error
+	RespChan chan JobResult
+}
+
+// JobResult is what a worker sends back on a Job's RespChan.
+type JobResult struct {
+	Err error
+}
+
+// WorkerPool runs Jobs on a fixed number of goroutines, fed from a bounded
+// queue, so a burst of requests can't start an unbounded number of renders.
+type WorkerPool struct {
+	workers int
+	jobs    chan Job
+}
+
+// NewWorkerPool starts workers goroutines pulling from a queue that holds at
+// most queueSize waiting jobs.
+func NewWorkerPool(workers, queueSize int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	p := &WorkerPool{
+		workers: workers,
+		jobs:    make(chan Job, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues job without blocking.  It returns ErrQueueFull if the queue
+// is saturated; otherwise exactly one JobResult will be sent on
+// job.RespChan, which should be buffered so a worker never blocks on a
+// handler that has gone away.
+func (p *WorkerPool) Submit(job Job) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// QueueDepth is the number of jobs waiting for a worker.
+func (p *WorkerPool) QueueDepth() int {
+	return len(p.jobs)
+}
+
+// RetryAfter estimates, in seconds, how long a rejected client should wait
+// before trying again: roughly one render per worker per second.
+func (p *WorkerPool) RetryAfter() int {
+	return 1 + p.QueueDepth()/p.workers
+}
+
+func (p *WorkerPool) work() {
+	for job := range p.jobs {
+		ctx := job.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if err := ctx.Err(); err != nil {
+			job.RespChan <- JobResult{Err: err}
+			continue
+		}
+		job.RespChan <- run(ctx, job)
+	}
+}
+
+// run runs job, turning a panic into an error so a bad source or a bug in a
+// processor fails one request rather than the whole server.
+func run(ctx context.Context, job Job) (result JobResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = JobResult{Err: fmt.Errorf("render panicked: %v", r)}
+		}
+	}()
+	return JobResult{Err: job.Run(ctx)}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWorkerPoolRunsJobs(t *testing.T) {
+	t.Parallel()
+
+	pool := NewWorkerPool(2, 4)
+	var out []byte
+	job := Job{
+		Run: func(ctx context.Context) error {
+			var err error
+			out, err = runCommand(ctx, "echo", "hello")
+			return err
+		},
+		RespChan: make(chan JobResult, 1),
+	}
+	if err := pool.Submit(job); err != nil {
+		t.Fatalf("Unexpected error submitting job: %s", err)
+	}
+
+	result := <-job.RespChan
+	if result.Err != nil {
+		t.Fatalf("Unexpected error running job: %s", result.Err)
+	}
+	if string(out) != "hello\n" {
+		t.Errorf("expected %q, got: %q", "hello\n", out)
+	}
+}
+
+func TestWorkerPoolSaturates(t *testing.T) {
+	t.Parallel()
+
+	// One worker stuck on a sleep and room for one more in the queue.
+	pool := NewWorkerPool(1, 1)
+	sleep := func() Job {
+		return Job{
+			Run: func(ctx context.Context) error {
+				_, err := runCommand(ctx, "sleep", "1")
+				return err
+			},
+			RespChan: make(chan JobResult, 1),
+		}
+	}
+
+	running := sleep()
+	if err := pool.Submit(running); err != nil {
+		t.Fatalf("Unexpected error submitting first job: %s", err)
+	}
+
+	// Keep submitting until the queue is full; the worker may or may not
+	// have picked up the first job yet.
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = pool.Submit(sleep())
+	}
+	if err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got: %v", err)
+	}
+	if pool.RetryAfter() < 1 {
+		t.Errorf("expected a positive Retry-After, got: %d", pool.RetryAfter())
+	}
+
+	if result := <-running.RespChan; result.Err != nil {
+		t.Errorf("Unexpected error running job: %s", result.Err)
+	}
+}
+
+func TestWorkerPoolRecoversPanics(t *testing.T) {
+	t.Parallel()
+
+	pool := NewWorkerPool(1, 1)
+	job := Job{
+		Run: func(ctx context.Context) error {
+			panic("bad source")
+		},
+		RespChan: make(chan JobResult, 1),
+	}
+	if err := pool.Submit(job); err != nil {
+		t.Fatalf("Unexpected error submitting job: %s", err)
+	}
+	if result := <-job.RespChan; result.Err == nil {
+		t.Errorf("expected the panic as an error")
+	}
+
+	// The worker is still there for the next job.
+	job.RespChan = make(chan JobResult, 1)
+	job.Run = func(ctx context.Context) error {
+		return nil
+	}
+	if err := pool.Submit(job); err != nil {
+		t.Fatalf("Unexpected error submitting job: %s", err)
+	}
+	if result := <-job.RespChan; result.Err != nil {
+		t.Errorf("expected the next job to run, got: %s", result.Err)
+	}
+}
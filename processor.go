@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Processor renders an ImageReq from a source image on disk.
+type Processor interface {
+	// Name is used in logs and config, e.g. "imagemagick".
+	Name() string
+	// Decodes reports whether the processor can read sources in format.
+	Decodes(format string) bool
+	// Encodes reports whether the processor can write format.
+	Encodes(format string) bool
+	// Identify reads what it can about the source image without decoding
+	// it.  Only the dimensions are required.
+	Identify(ctx context.Context, src string) (ImageMetadata, error)
+	// Process applies imgReq's region, size, rotation and quality to src and
+	// writes the result, encoded as imgReq.Format, to w.  imgReq.Stats are
+	// src's dimensions, if they're already known.
+	Process(ctx context.Context, src string, imgReq ImageReq, w io.Writer) error
+}
+
+// newProcessor returns the Processor registered under name.  memLimit only
+// applies to imagemagick.
+func newProcessor(name string, memLimit string) (Processor, error) {
+	switch strings.ToLower(name) {
+	case "", "imagemagick", "convert":
+		return ImageMagickProcessor{MemLimit: memLimit}, nil
+	case "go":
+		return GoProcessor{MaxSourcePixels: defaultGoMaxSourcePixels}, nil
+	case "vips", "libvips":
+		if _, err := exec.LookPath("vips"); err != nil {
+			return nil, fmt.Errorf("vips processor selected but: %s", err)
+		}
+		return VipsProcessor{}, nil
+	default:
+		return nil, fmt.Errorf("unknown processor: %s", name)
+	}
+}
+
+// ImageMagickProcessor shells out to convert and identify.
+type ImageMagickProcessor struct {
+	// MemLimit is passed to convert's -limit memory, e.g. "50MiB".
+	MemLimit string
+}
+
+// Name .
+func (ImageMagickProcessor) Name() string {
+	return "imagemagick"
+}
+
+// Decodes .
+func (ImageMagickProcessor) Decodes(format string) bool {
+	return true
+}
+
+// Encodes .
+func (ImageMagickProcessor) Encodes(format string) bool {
+	return true
+}
+
+// Identify .
+func (ImageMagickProcessor) Identify(ctx context.Context, src string) (ImageMetadata, error) {
+	out, err := runCommand(ctx, "identify", "-ping", "-format", identifyFormat, src)
+	if err != nil {
+		return ImageMetadata{}, err
+	}
+	return parseIdentify(string(out))
+}
+
+// Process .
+func (p ImageMagickProcessor) Process(
+	ctx context.Context,
+	src string,
+	imgReq ImageReq,
+	w io.Writer,
+) error {
+	args, err := imgReq.buildArgs(ctx, src, p.MemLimit)
+	if err != nil {
+		return err
+	}
+
+	err = streamCommand(ctx, w, "convert", args...)
+	if err != nil && err != ctx.Err() {
+		return fmt.Errorf("err running convert with args %q: %s", args, err)
+	}
+	return err
+}
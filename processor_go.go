@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+
+	"golang.org/x/image/tiff"
+	// Registers the webp decoder with image.Decode.
+	_ "golang.org/x/image/webp"
+)
+
+// GoProcessor renders images with the standard library and x/image, so it
+// works without ImageMagick installed.  It's slower and supports fewer
+// formats: no jp2 or pdf at all, and webp only as a source.
+type GoProcessor struct {
+	// MaxSourcePixels is the biggest source, by width*height, we'll decode.
+	// Sources are decoded whole into memory, and a small file can claim
+	// enormous dimensions.  0 means no limit.
+	MaxSourcePixels int
+}
+
+// defaultGoMaxSourcePixels is about a gigabyte once decoded.
+const defaultGoMaxSourcePixels = 256 * 1000 * 1000
+
+var goDecodes = []string{"jpg", "png", "gif", "tif", "webp"}
+var goEncodes = []string{"jpg", "png", "gif", "tif"}
+
+// Name .
+func (GoProcessor) Name() string {
+	return "go"
+}
+
+// Decodes .
+func (GoProcessor) Decodes(format string) bool {
+	return contains(goDecodes, format)
+}
+
+// Encodes .
+func (GoProcessor) Encodes(format string) bool {
+	return contains(goEncodes, format)
+}
+
+// Identify reads just the image header, which has no more than the
+// dimensions and color model.
+func (GoProcessor) Identify(ctx context.Context, src string) (ImageMetadata, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return ImageMetadata{}, err
+	}
+	defer f.Close()
+
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return ImageMetadata{}, err
+	}
+	meta := ImageMetadata{
+		Width:      cfg.Width,
+		Height:     cfg.Height,
+		Format:     format,
+		ColorSpace: "srgb",
+		BitDepth:   8,
+		Pages:      1,
+	}
+	switch cfg.ColorModel {
+	case color.GrayModel:
+		meta.ColorSpace = "gray"
+	case color.Gray16Model:
+		meta.ColorSpace, meta.BitDepth = "gray", 16
+	case color.RGBA64Model, color.NRGBA64Model:
+		meta.BitDepth = 16
+	case color.CMYKModel:
+		meta.ColorSpace = "cmyk"
+	}
+	return meta, nil
+}
+
+// Process .
+func (p GoProcessor) Process(
+	ctx context.Context,
+	src string,
+	imgReq ImageReq,
+	w io.Writer,
+) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Check the header before decoding the lot.
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("err decoding %s: %s", src, err)
+	}
+	source := WidthHeight{Width: cfg.Width, Height: cfg.Height}
+	if p.MaxSourcePixels > 0 && overArea(source, p.MaxSourcePixels) {
+		return &RequestError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("%s: source is %dx%d", ErrTooManyPixels, cfg.Width, cfg.Height),
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	decoded, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("err decoding %s: %s", src, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b := decoded.Bounds()
+	stats := WidthHeight{Width: b.Dx(), Height: b.Dy()}
+	crop, err := regionRect(imgReq.Region, stats)
+	if err != nil {
+		return err
+	}
+	img := toRGBA(decoded, crop.Add(b.Min))
+
+	size, err := imgReq.outputFor(WidthHeight{Width: crop.Dx(), Height: crop.Dy()})
+	if err != nil {
+		return err
+	}
+	img = resizeRGBA(img, size.Width, size.Height)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch rotation := imgReq.Rotation.(type) {
+	case RotateStandard:
+		img = rotateRGBA(img, rotation.Degrees)
+	case RotateMirrored:
+		img = rotateRGBA(flopRGBA(img), rotation.Degrees)
+	default:
+		return fmt.Errorf("Unrecognized rotation : %v", imgReq.Rotation)
+	}
+
+	var out image.Image = img
+	switch imgReq.Quality {
+	case "default", "color":
+	case "gray":
+		out = toGray(img, false)
+	case "bitonal":
+		out = toGray(img, true)
+	default:
+		return fmt.Errorf("Unrecognized Quality : %v", imgReq.Quality)
+	}
+
+	return encodeImage(w, out, imgReq.Format)
+}
+
+// toRGBA copies the r portion of img into a new RGBA image with its origin
+// at 0,0.
+func toRGBA(img image.Image, r image.Rectangle) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// resizeRGBA scales src to w x h with a separable triangle filter whose
+// support grows with the scale factor, so downscaling averages every source
+// pixel rather than skipping some.
+func resizeRGBA(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw == w && sh == h {
+		return src
+	}
+
+	// Horizontal pass into a float buffer, w x sh.
+	xWeights := filterWeights(sw, w)
+	tmp := make([]float32, w*sh*4)
+	for y := 0; y < sh; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, c := range xWeights {
+			var acc [4]float32
+			for i, weight := range c.weights {
+				p := row[(c.start+i)*4:]
+				acc[0] += weight * float32(p[0])
+				acc[1] += weight * float32(p[1])
+				acc[2] += weight * float32(p[2])
+				acc[3] += weight * float32(p[3])
+			}
+			copy(tmp[(y*w+x)*4:], acc[:])
+		}
+	}
+
+	// Vertical pass into the destination, w x h.
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	yWeights := filterWeights(sh, h)
+	for y, c := range yWeights {
+		for x := 0; x < w; x++ {
+			var acc [4]float32
+			for i, weight := range c.weights {
+				p := tmp[((c.start+i)*w+x)*4:]
+				acc[0] += weight * p[0]
+				acc[1] += weight * p[1]
+				acc[2] += weight * p[2]
+				acc[3] += weight * p[3]
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			for ch := 0; ch < 4; ch++ {
+				d[ch] = clampUint8(acc[ch])
+			}
+		}
+	}
+	return dst
+}
+
+type filterContrib struct {
+	start   int
+	weights []float32
+}
+
+// filterWeights computes, for each of dstLen output pixels, which source
+// pixels contribute to it and by how much.
+func filterWeights(srcLen, dstLen int) []filterContrib {
+	scale := float64(srcLen) / float64(dstLen)
+	support := math.Max(scale, 1)
+
+	contribs := make([]filterContrib, dstLen)
+	for i := range contribs {
+		center := (float64(i) + 0.5) * scale
+		lo := int(math.Floor(center - support))
+		hi := int(math.Ceil(center + support))
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > srcLen {
+			hi = srcLen
+		}
+
+		weights := make([]float32, hi-lo)
+		var sum float64
+		for j := lo; j < hi; j++ {
+			weight := 1 - math.Abs(float64(j)+0.5-center)/support
+			if weight < 0 {
+				weight = 0
+			}
+			weights[j-lo] = float32(weight)
+			sum += weight
+		}
+		if sum > 0 {
+			for j := range weights {
+				weights[j] /= float32(sum)
+			}
+		}
+		contribs[i] = filterContrib{start: lo, weights: weights}
+	}
+	return contribs
+}
+
+// flopRGBA mirrors img left to right.
+func flopRGBA(img *image.RGBA) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			copy(dst.Pix[y*dst.Stride+(w-1-x)*4:][:4], img.Pix[y*img.Stride+x*4:][:4])
+		}
+	}
+	return dst
+}
+
+// rotateRGBA rotates img clockwise by degrees, growing the canvas to fit the
+// result.  Uncovered corners are left transparent.
+func rotateRGBA(img *image.RGBA, degrees float64) *image.RGBA {
+	degrees = math.Mod(degrees, 360)
+	if degrees == 0 {
+		return img
+	}
+
+	w, h := float64(img.Bounds().Dx()), float64(img.Bounds().Dy())
+	rad := degrees * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+
+	// Shave a little off before rounding up so 90 degrees doesn't come out a
+	// pixel too big from floating point noise.
+	const epsilon = 1e-9
+	nw := int(math.Ceil(math.Abs(w*cos) + math.Abs(h*sin) - epsilon))
+	nh := int(math.Ceil(math.Abs(w*sin) + math.Abs(h*cos) - epsilon))
+
+	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	cx, cy := w/2, h/2
+	ncx, ncy := float64(nw)/2, float64(nh)/2
+	for y := 0; y < nh; y++ {
+		for x := 0; x < nw; x++ {
+			// Map the destination pixel centre back into the source.
+			dx, dy := float64(x)+0.5-ncx, float64(y)+0.5-ncy
+			sx := dx*cos + dy*sin + cx
+			sy := -dx*sin + dy*cos + cy
+			c := bilinearAt(img, sx-0.5, sy-0.5)
+			copy(dst.Pix[y*dst.Stride+x*4:][:4], c[:])
+		}
+	}
+	return dst
+}
+
+// bilinearAt samples img at fractional pixel coordinates, treating
+// everything outside the image as transparent.
+func bilinearAt(img *image.RGBA, fx, fy float64) [4]uint8 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	x0, y0 := int(math.Floor(fx)), int(math.Floor(fy))
+	ax, ay := float32(fx-float64(x0)), float32(fy-float64(y0))
+
+	wx := [2]float32{1 - ax, ax}
+	wy := [2]float32{1 - ay, ay}
+	var acc [4]float32
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 2; i++ {
+			x, y := x0+i, y0+j
+			if x < 0 || y < 0 || x >= w || y >= h {
+				continue
+			}
+			p := img.Pix[y*img.Stride+x*4:]
+			for ch := 0; ch < 4; ch++ {
+				acc[ch] += wx[i] * wy[j] * float32(p[ch])
+			}
+		}
+	}
+
+	var out [4]uint8
+	for ch := 0; ch < 4; ch++ {
+		out[ch] = clampUint8(acc[ch])
+	}
+	return out
+}
+
+// toGray converts img to grayscale, thresholding to pure black and white if
+// bitonal is set.
+func toGray(img *image.RGBA, bitonal bool) *image.Gray {
+	flat := flatten(img)
+	gray := image.NewGray(flat.Bounds())
+	draw.Draw(gray, gray.Bounds(), flat, flat.Bounds().Min, draw.Src)
+	if bitonal {
+		for i, v := range gray.Pix {
+			if v < 128 {
+				gray.Pix[i] = 0
+			} else {
+				gray.Pix[i] = 255
+			}
+		}
+	}
+	return gray
+}
+
+// flatten composites img onto white, for formats and qualities without
+// transparency.  This matches convert's default background.
+func flatten(img *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpg":
+		if rgba, ok := img.(*image.RGBA); ok {
+			img = flatten(rgba)
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	case "tif":
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+	default:
+		return fmt.Errorf("go processor can't encode %s", format)
+	}
+}
+
+func clampUint8(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
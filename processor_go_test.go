@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"net/http"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestGoProcessor(t *testing.T) {
+	t.Parallel()
+
+	// images/sample2.png is 300x200.
+	tests := []struct {
+		region   interface{}
+		size     interface{}
+		rotation interface{}
+		format   string
+		width    int
+		height   int
+	}{
+		{RegionFull{}, SizeFull{}, RotateStandard{Degrees: 0}, "png", 300, 200},
+		{RegionFull{}, SizePercent{Percent: 50}, RotateStandard{Degrees: 0}, "jpg", 150, 100},
+		{RegionExact{X: 10, Y: 20, Width: 100, Height: 50}, SizeWidth{Width: 50},
+			RotateStandard{Degrees: 90}, "png", 25, 50},
+		{RegionExact{X: 250, Y: 150, Width: 100, Height: 100}, SizeFull{},
+			RotateMirrored{Degrees: 0}, "gif", 50, 50},
+		{RegionPercent{X: 0, Y: 0, Width: 50, Height: 50}, SizeHeight{Height: 200},
+			RotateStandard{Degrees: 180}, "png", 300, 200},
+		{RegionFull{}, SizeBestFit{Width: 60, Height: 60}, RotateStandard{Degrees: 0},
+			"png", 60, 40},
+		{RegionFull{}, SizeExact{Width: 10, Height: 10}, RotateStandard{Degrees: 45},
+			"png", 15, 15},
+	}
+
+	for _, test := range tests {
+		imgReq := ImageReq{
+			Identifier: "sample2",
+			Region:     test.region,
+			Size:       test.size,
+			Rotation:   test.rotation,
+			Quality:    "default",
+			Format:     test.format,
+		}
+
+		var buf bytes.Buffer
+		err := GoProcessor{}.Process(context.Background(), "images/sample2.png", imgReq, &buf)
+		if err != nil {
+			t.Errorf("Unexpected error processing %+v: %s", imgReq, err)
+			continue
+		}
+
+		cfg, format, err := image.DecodeConfig(&buf)
+		if err != nil {
+			t.Errorf("Couldn't decode output for %+v: %s", imgReq, err)
+			continue
+		}
+		if cfg.Width != test.width || cfg.Height != test.height {
+			t.Errorf("expected %dx%d, got: %dx%d for %+v",
+				test.width, test.height, cfg.Width, cfg.Height, imgReq)
+		}
+		if expected := map[string]string{"jpg": "jpeg"}[test.format]; expected != "" && format != expected {
+			t.Errorf("expected format %s, got: %s", expected, format)
+		}
+	}
+}
+
+func TestGoProcessorRefusesHugeSources(t *testing.T) {
+	t.Parallel()
+
+	// sample2 is 300x200; only the header should be read.
+	imgReq := ImageReq{
+		Region:   RegionExact{X: 0, Y: 0, Width: 10, Height: 10},
+		Size:     SizeFull{},
+		Rotation: RotateStandard{Degrees: 0},
+		Quality:  "default",
+		Format:   "png",
+	}
+	var buf bytes.Buffer
+	p := GoProcessor{MaxSourcePixels: 300*200 - 1}
+	err := p.Process(context.Background(), "images/sample2.png", imgReq, &buf)
+	reqErr, ok := err.(*RequestError)
+	if !ok || reqErr.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a 413, got: %v", err)
+	}
+
+	p.MaxSourcePixels = 300 * 200
+	if err := p.Process(context.Background(), "images/sample2.png", imgReq, &buf); err != nil {
+		t.Errorf("Unexpected error at the cap: %s", err)
+	}
+}
+
+func TestGoProcessorBitonalTiff(t *testing.T) {
+	t.Parallel()
+
+	imgReq := ImageReq{
+		Region:   RegionFull{},
+		Size:     SizeWidth{Width: 100},
+		Rotation: RotateStandard{Degrees: 0},
+		Quality:  "bitonal",
+		Format:   "tif",
+	}
+
+	var buf bytes.Buffer
+	err := GoProcessor{}.Process(context.Background(), "images/sample.png", imgReq, &buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	img, err := tiff.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Couldn't decode tiff output: %s", err)
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			if r != g || g != bl || (r != 0 && r != 0xffff) {
+				t.Fatalf("expected only black and white, got: %v at %d,%d", img.At(x, y), x, y)
+			}
+		}
+	}
+}
+
+func TestGoProcessorIdentify(t *testing.T) {
+	t.Parallel()
+
+	meta, err := GoProcessor{}.Identify(context.Background(), "images/sample.png")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if meta.Dimensions() != (WidthHeight{Width: 131, Height: 175}) {
+		t.Errorf("expected 131x175, got: %v", meta.Dimensions())
+	}
+	if meta.Format != "png" || meta.Pages != 1 || meta.BitDepth == 0 {
+		t.Errorf("expected a one page png, got: %+v", meta)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// VipsProcessor shells out to the libvips command line tools.  Unlike
+// convert, vips only decodes the parts of the source it needs: a full-region
+// resize goes through "vips thumbnail", which shrinks on load, and crops
+// read just the requested area when the format allows random access.
+type VipsProcessor struct{}
+
+var vipsDecodes = []string{"jpg", "png", "gif", "tif", "webp", "jp2", "pdf"}
+var vipsEncodes = []string{"jpg", "png", "gif", "tif", "webp", "jp2"}
+
+// Name .
+func (VipsProcessor) Name() string {
+	return "vips"
+}
+
+// Decodes .
+func (VipsProcessor) Decodes(format string) bool {
+	return contains(vipsDecodes, format)
+}
+
+// Encodes .
+func (VipsProcessor) Encodes(format string) bool {
+	return contains(vipsEncodes, format)
+}
+
+// Identify .
+func (VipsProcessor) Identify(ctx context.Context, src string) (ImageMetadata, error) {
+	out, err := runCommand(ctx, "vipsheader", "-a", src)
+	if err != nil {
+		return ImageMetadata{}, err
+	}
+	return parseVipsHeader(string(out))
+}
+
+// dimensions are imgReq.Stats, or src's if they're not known yet.
+func (p VipsProcessor) dimensions(ctx context.Context, src string, imgReq ImageReq) (WidthHeight, error) {
+	if imgReq.Stats != (WidthHeight{}) {
+		return imgReq.Stats, nil
+	}
+	meta, err := p.Identify(ctx, src)
+	return meta.Dimensions(), err
+}
+
+// Process runs one vips command per operation.  The command line tools
+// can't chain operations, so each one but the last writes an uncompressed
+// .v file to a scratch directory for the next to read: that costs disk the
+// size of the region after any shrink-on-load, 4 bytes a pixel for RGBA,
+// for every extra operation.  The last writes the output straight away, so
+// a plain tile or thumbnail needs no intermediates at all.
+func (p VipsProcessor) Process(
+	ctx context.Context,
+	src string,
+	imgReq ImageReq,
+	w io.Writer,
+) error {
+	stats, err := p.dimensions(ctx, src, imgReq)
+	if err != nil {
+		return err
+	}
+
+	crop, err := regionRect(imgReq.Region, stats)
+	if err != nil {
+		return err
+	}
+	size, err := imgReq.outputFor(WidthHeight{Width: crop.Dx(), Height: crop.Dy()})
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "iiif-vips")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pipe := &vipsPipeline{ctx: ctx, dir: tmpDir, current: src}
+
+	if _, ok := imgReq.Region.(RegionFull); ok {
+		if size != stats {
+			// thumbnail picks the cheapest way to get close to the target
+			// size, eg. jpeg DCT scaling or a lower jp2/tiff pyramid level.
+			// It would turn the image upright by its EXIF orientation, which
+			// neither crops nor vipsheader's dimensions do.
+			pipe.run("thumbnail", strconv.Itoa(size.Width),
+				"--height", strconv.Itoa(size.Height), "--size", "force", "--no-rotate")
+		}
+	} else {
+		// jpegs can be shrunk by a power of two while decoding, which saves
+		// most of the work when a tile is being scaled down.
+		shrink := 1
+		if filepath.Ext(src) == ".jpg" {
+			for shrink < 8 &&
+				crop.Dx()/(shrink*2) >= size.Width &&
+				crop.Dy()/(shrink*2) >= size.Height {
+				shrink *= 2
+			}
+		}
+		if shrink > 1 {
+			pipe.current = fmt.Sprintf("%s[shrink=%d]", src, shrink)
+		} else {
+			pipe.current = src + "[access=random]"
+		}
+
+		x, y := crop.Min.X/shrink, crop.Min.Y/shrink
+		cw, ch := crop.Dx()/shrink, crop.Dy()/shrink
+		if cw < 1 {
+			cw = 1
+		}
+		if ch < 1 {
+			ch = 1
+		}
+		pipe.run("crop",
+			strconv.Itoa(x), strconv.Itoa(y), strconv.Itoa(cw), strconv.Itoa(ch))
+
+		if cw != size.Width || ch != size.Height {
+			pipe.run("resize",
+				strconv.FormatFloat(float64(size.Width)/float64(cw), 'f', -1, 64),
+				"--vscale", strconv.FormatFloat(float64(size.Height)/float64(ch), 'f', -1, 64))
+		}
+	}
+
+	var degrees float64
+	switch rotation := imgReq.Rotation.(type) {
+	case RotateStandard:
+		degrees = rotation.Degrees
+	case RotateMirrored:
+		pipe.run("flip", "horizontal")
+		degrees = rotation.Degrees
+	default:
+		return fmt.Errorf("Unrecognized rotation : %v", imgReq.Rotation)
+	}
+	switch math.Mod(degrees, 360) {
+	case 0:
+	case 90:
+		pipe.run("rot", "d90")
+	case 180:
+		pipe.run("rot", "d180")
+	case 270:
+		pipe.run("rot", "d270")
+	default:
+		// similarity's angle is clockwise, same as IIIF's.
+		pipe.run("similarity", "--angle", strconv.FormatFloat(degrees, 'f', -1, 64))
+	}
+
+	switch imgReq.Quality {
+	case "default", "color":
+	case "gray":
+		pipe.run("colourspace", "b-w")
+	case "bitonal":
+		pipe.run("colourspace", "b-w")
+		pipe.run("relational_const", "moreeq", "128")
+	default:
+		return fmt.Errorf("Unrecognized Quality : %v", imgReq.Quality)
+	}
+
+	// vips picks the saver from the extension.
+	out := filepath.Join(tmpDir, "out."+imgReq.Format)
+	if err := pipe.execute(out); err != nil {
+		return err
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// vipsPipeline threads an image through a series of "vips <op> in out"
+// commands.
+type vipsPipeline struct {
+	ctx     context.Context
+	dir     string
+	current string
+	ops     [][]string
+}
+
+// run adds op to the pipeline.
+func (p *vipsPipeline) run(op string, args ...string) {
+	p.ops = append(p.ops, append([]string{op}, args...))
+}
+
+// execute runs the pipeline, writing the result to out.  It stops at the
+// first command that fails.
+func (p *vipsPipeline) execute(out string) error {
+	if len(p.ops) == 0 {
+		p.run("copy")
+	}
+	for i, op := range p.ops {
+		next := out
+		if i < len(p.ops)-1 {
+			next = filepath.Join(p.dir, fmt.Sprintf("%d.v", i+1))
+		}
+		cmdArgs := append([]string{op[0], p.current, next}, op[1:]...)
+		if _, err := runCommand(p.ctx, "vips", cmdArgs...); err != nil {
+			if p.ctx.Err() != nil {
+				return p.ctx.Err()
+			}
+			return fmt.Errorf("vips %s failed: %s", op[0], err)
+		}
+		p.current = next
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+)
+
+// Compare the backends on the sample images.  Backends whose tools aren't
+// installed are skipped, e.g.
+//
+//	go test -run XXX -bench Processors
+func BenchmarkProcessors(b *testing.B) {
+	processors := []struct {
+		processor Processor
+		requires  string
+	}{
+		{ImageMagickProcessor{}, "convert"},
+		{VipsProcessor{}, "vips"},
+		{GoProcessor{}, ""},
+	}
+
+	requests := []struct {
+		name   string
+		src    string
+		region interface{}
+		size   interface{}
+	}{
+		// big.jpg is 4000x2656.
+		{"tile", "images/big.jpg",
+			RegionExact{X: 1024, Y: 1024, Width: 1024, Height: 1024}, SizeWidth{Width: 256}},
+		{"thumbnail", "images/big.jpg", RegionFull{}, SizeBestFit{Width: 200, Height: 200}},
+		{"full", "images/abundance.jpg", RegionFull{}, SizeFull{}},
+	}
+
+	for _, p := range processors {
+		for _, req := range requests {
+			b.Run(p.processor.Name()+"/"+req.name, func(b *testing.B) {
+				if p.requires != "" {
+					if _, err := exec.LookPath(p.requires); err != nil {
+						b.Skipf("%s not installed", p.requires)
+					}
+				}
+
+				imgReq := ImageReq{
+					Region:   req.region,
+					Size:     req.size,
+					Rotation: RotateStandard{Degrees: 0},
+					Quality:  "default",
+					Format:   "jpg",
+				}
+				for i := 0; i < b.N; i++ {
+					err := p.processor.Process(context.Background(), req.src, imgReq, ioutil.Discard)
+					if err != nil {
+						b.Fatalf("Unexpected error: %s", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// oriented.jpg is stored 64x32, red on the left and blue on the right, with
+// an EXIF orientation that says to turn it a quarter clockwise.  Everything
+// else about it is read as stored, so renders of it should be too.
+func TestVipsIgnoresOrientation(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("vips"); err != nil {
+		t.Skip("vips not installed")
+	}
+
+	for _, region := range []interface{}{RegionFull{}, RegionExact{X: 0, Y: 0, Width: 64, Height: 32}} {
+		imgReq := ImageReq{
+			Region:   region,
+			Size:     SizeWidth{Width: 32},
+			Rotation: RotateStandard{Degrees: 0},
+			Quality:  "default",
+			Format:   "png",
+		}
+		var buf bytes.Buffer
+		if err := (VipsProcessor{}).Process(context.Background(), "images/oriented.jpg", imgReq, &buf); err != nil {
+			t.Fatalf("Unexpected error rendering %T: %s", region, err)
+		}
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %T: %s", region, err)
+		}
+		if img.Bounds() != image.Rect(0, 0, 32, 16) {
+			t.Errorf("expected 32x16 for %T, got: %v", region, img.Bounds())
+		}
+		if r, _, b, _ := img.At(2, 8).RGBA(); r < b {
+			t.Errorf("expected red on the left for %T, got: %v", region, img.At(2, 8))
+		}
+	}
+}
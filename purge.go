@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ErrPurgeTarget .
+const ErrPurgeTarget = "Give exactly one of identifier or prefix"
+
+// purgeResult is the response to a purge.
+type purgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// purgeHandler removes cached renders at /admin/purge.  It takes one of
+//
+//	?identifier=scans/ms-12/f1r    renders of that image
+//	?prefix=scans/ms-12/           renders of every image under it
+//
+// where identifiers include their collection's prefix, if there is one.
+// The images' metadata goes too, so they're identified again.  Renders of
+// a source that has changed are dropped on their own the next time they're
+// asked for; this is for when they have to go now.
+func purgeHandler(ctx Context, w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(ctx.config.Load(), w, r) {
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		writeError(w, r, &RequestError{
+			Status:  http.StatusMethodNotAllowed,
+			Message: "purge with POST or DELETE",
+		})
+		return
+	}
+
+	query := r.URL.Query()
+	identifier, prefix := query.Get("identifier"), query.Get("prefix")
+	if (identifier == "") == (prefix == "") {
+		writeError(w, r, badRequest("", errors.New(ErrPurgeTarget)))
+		return
+	}
+
+	var n int
+	if identifier != "" {
+		n = ctx.cache.Purge(identifier, false)
+		ctx.metadata.Purge(identifier, false)
+	} else {
+		n = ctx.cache.Purge(prefix, true)
+		ctx.metadata.Purge(prefix, true)
+	}
+	logrus.WithFields(logrus.Fields{
+		"identifier": identifier,
+		"prefix":     prefix,
+		"purged":     n,
+	}).Info("purged cache")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(purgeResult{Purged: n})
+}
+
+// purgeCommand is `iiif-server purge`, which asks a running server to purge
+// its cache, since the server's index and memory tier would go on serving
+// anything removed from the cache directory behind its back.
+func purgeCommand(args []string) error {
+	fs := flag.NewFlagSet("iiif-server purge", flag.ContinueOnError)
+	server := fs.String("server", "http://localhost:8080", "the server to purge")
+	token := fs.String("token", os.Getenv("IIIF_ADMIN_TOKEN"), "admin token, if it needs one (IIIF_ADMIN_TOKEN)")
+	prefix := fs.Bool("prefix", false, "purge every image under the identifier given")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: iiif-server purge [flags] identifier")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("purge takes one identifier")
+	}
+
+	param := "identifier"
+	if *prefix {
+		param = "prefix"
+	}
+	purgeURL := strings.TrimRight(*server, "/") + "/admin/purge?" +
+		url.Values{param: {fs.Arg(0)}}.Encode()
+	req, err := http.NewRequest(http.MethodPost, purgeURL, nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result purgeResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("err decoding response: %s", err)
+	}
+	fmt.Printf("purged %d cached renders\n", result.Purged)
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceChangesInvalidate(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "iiif-sources")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	replace := func(sample string, mtime time.Time) {
+		data, err := ioutil.ReadFile(filepath.Join("images", sample))
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s: %s", sample, err)
+		}
+		path := filepath.Join(root, "scan.png")
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Unexpected error writing scan: %s", err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	ctx := testContext(t, []*Collection{{Prefix: "scans", Resolver: ResolverConfig{Root: root}}})
+	router := newRouter(ctx)
+	get := func() []byte {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/scans/scan/full/full/0/default.png", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got: %d %s", w.Code, w.Body.String())
+		}
+		return w.Body.Bytes()
+	}
+
+	replace("sample2.png", time.Now().Add(-time.Hour))
+	first := get()
+	replace("sample.png", time.Now())
+	if second := get(); bytes.Equal(first, second) {
+		t.Errorf("expected a new render of the replaced scan")
+	}
+	if n := ctx.cache.(*MemoryCache).Len(); n != 1 {
+		t.Errorf("expected the old render to be dropped, got: %d entries", n)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{
+		{Resolver: ResolverConfig{Root: "images"}},
+		{Prefix: "scans", Resolver: ResolverConfig{Root: "images"}},
+	})
+	ctx.config.Load().Admin = AccessRules{Tokens: []string{"secret"}}
+	if err := ctx.config.Load().Admin.init(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	router := newRouter(ctx)
+	for _, path := range []string{
+		"/sample2/full/50,/0/default.png",
+		"/sample2/full/60,/0/default.png",
+		"/scans/sample2/full/50,/0/default.png",
+		"/scans/sample/full/50,/0/default.png",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	}
+	cache := ctx.cache.(*MemoryCache)
+	if cache.Len() != 4 {
+		t.Fatalf("expected 4 cached renders, got: %d", cache.Len())
+	}
+
+	purge := func(method, query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/purge?"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, test := range []struct {
+		method, query, token string
+		status               int
+	}{
+		{"POST", "identifier=sample2", "", http.StatusUnauthorized},
+		{"GET", "identifier=sample2", "secret", http.StatusMethodNotAllowed},
+		{"POST", "", "secret", http.StatusBadRequest},
+		{"POST", "identifier=sample2&prefix=scans/", "secret", http.StatusBadRequest},
+	} {
+		if w := purge(test.method, test.query, test.token); w.Code != test.status {
+			t.Errorf("expected %d for %s %s, got: %d", test.status, test.method, test.query, w.Code)
+		}
+	}
+
+	w := purge("POST", "identifier=sample2", "secret")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"purged":2}` {
+		t.Errorf("expected 2 purged, got: %d %s", w.Code, w.Body.String())
+	}
+
+	// The CLI goes through the same endpoint.
+	server := httptest.NewServer(router)
+	defer server.Close()
+	err := purgeCommand([]string{"-server", server.URL, "-token", "secret", "-prefix", "scans/"})
+	if err != nil {
+		t.Errorf("Unexpected error purging: %s", err)
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expected everything purged, got: %d entries", cache.Len())
+	}
+	err = purgeCommand([]string{"-server", server.URL, "sample2"})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected a 401 without the token, got: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Source is a master image found by a Resolver, available as a local file
+// that the processors can read.
+type Source struct {
+	Identifier string
+	Format     string
+	Path       string
+	Size       int64
+	ModTime    time.Time
+}
+
+// Resolver maps identifiers to master images.
+type Resolver interface {
+	// Resolve returns the first of formats, in order, that exists for
+	// identifier, or an ErrNoSource error if none do.
+	Resolve(ctx context.Context, identifier string, formats []string) (*Source, error)
+}
+
+// Lister is a Resolver that can enumerate the images it has.
+type Lister interface {
+	// List returns, sorted, every identifier that is prefix or under it,
+	// matching whole path segments as purges do.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// ResolverConfig picks and configures a Resolver.  Type is one of "file"
+// (the default), "http" or "s3".
+type ResolverConfig struct {
+	Type     string `yaml:"type" json:"type"`
+	Root     string `yaml:"root" json:"root"`
+	URL      string `yaml:"url" json:"url"`
+	CacheDir string `yaml:"cacheDir" json:"cacheDir"`
+	// CacheMaxBytes bounds the masters http and s3 keep in CacheDir.
+	CacheMaxBytes int64    `yaml:"cacheMaxBytes" json:"cacheMaxBytes"`
+	Revalidate    Duration `yaml:"revalidate" json:"revalidate"`
+	S3            S3Config `yaml:"s3" json:"s3"`
+}
+
+// defaultSourceCacheBytes is how much of CacheDir masters may take up by
+// default.
+const defaultSourceCacheBytes = 10 << 30
+
+// resolverConfigFromEnv is the resolver used when there are no collections
+// in the config.
+func resolverConfigFromEnv(getenv func(string) string) ResolverConfig {
+	cfg := ResolverConfig{
+		Type:     getenv("RESOLVER"),
+		Root:     getenv("IMAGE_ROOT"),
+		URL:      getenv("RESOLVER_URL"),
+		CacheDir: getenv("RESOLVER_CACHE_DIR"),
+		S3: S3Config{
+			Endpoint:  getenv("S3_ENDPOINT"),
+			Region:    getenv("S3_REGION"),
+			Bucket:    getenv("S3_BUCKET"),
+			Prefix:    getenv("S3_PREFIX"),
+			AccessKey: getenv("S3_ACCESS_KEY"),
+			SecretKey: getenv("S3_SECRET_KEY"),
+		},
+	}
+	if d, err := time.ParseDuration(getenv("RESOLVER_REVALIDATE")); err == nil {
+		cfg.Revalidate = Duration{d}
+	}
+	if n, err := strconv.ParseInt(getenv("RESOLVER_CACHE_MAX_BYTES"), 10, 64); err == nil {
+		cfg.CacheMaxBytes = n
+	}
+	return cfg
+}
+
+func newResolver(cfg ResolverConfig) (Resolver, error) {
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = "sourceCache"
+	}
+	maxBytes := cfg.CacheMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultSourceCacheBytes
+	}
+	revalidate := cfg.Revalidate.Duration
+	if revalidate == 0 {
+		revalidate = 5 * time.Minute
+	}
+
+	switch cfg.Type {
+	case "", "file":
+		root := cfg.Root
+		if root == "" {
+			root = "images"
+		}
+		return FileResolver{Root: root}, nil
+	case "http":
+		if cfg.URL == "" {
+			return nil, errors.New("url is required for the http resolver")
+		}
+		return NewHTTPResolver(cfg.URL, cacheDir, maxBytes, revalidate), nil
+	case "s3":
+		s3 := cfg.S3
+		if s3.Endpoint == "" || s3.Bucket == "" {
+			return nil, errors.New("endpoint and bucket are required for the s3 resolver")
+		}
+		if s3.Region == "" {
+			s3.Region = "us-east-1"
+		}
+		return NewS3Resolver(s3, cacheDir, maxBytes, revalidate), nil
+	default:
+		return nil, fmt.Errorf("unknown resolver: %s", cfg.Type)
+	}
+}
+
+// sourceFormats is the order, from sourcePreference, in which masters are
+// worth trying for processor.
+func sourceFormats(processor Processor) []string {
+	var formats []string
+	for _, format := range sourcePreference {
+		if processor.Decodes(format) {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// FileResolver looks for <Root>/<identifier>.<format>.  Identifiers may
+// contain slashes to reach into nested directories.
+type FileResolver struct {
+	Root string
+}
+
+// Resolve .
+func (fr FileResolver) Resolve(
+	ctx context.Context,
+	identifier string,
+	formats []string,
+) (*Source, error) {
+	base, err := fr.path(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO(cgag): parallelize?
+	for _, format := range formats {
+		path := base + "." + format
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		return &Source{
+			Identifier: identifier,
+			Format:     format,
+			Path:       path,
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+		}, nil
+	}
+	return nil, errors.New(ErrNoSource)
+}
+
+// path maps identifier under Root, refusing anything that would escape it.
+// parseIdentifier already rejects ".." but this is cheap insurance.
+func (fr FileResolver) path(identifier string) (string, error) {
+	root := filepath.Clean(fr.Root)
+	path := filepath.Join(root, filepath.FromSlash(identifier))
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", errors.New(ErrNoSource)
+	}
+	return path, nil
+}
+
+// List finds every master under Root whose format we know, named for the
+// identifier it's served as.
+func (fr FileResolver) List(ctx context.Context, prefix string) ([]string, error) {
+	root := filepath.Clean(fr.Root)
+	seen := make(map[string]bool)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != root {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		ext := filepath.Ext(path)
+		if !contains(sourcePreference, strings.TrimPrefix(ext, ".")) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, strings.TrimSuffix(path, ext))
+		if err != nil {
+			return err
+		}
+		if id := filepath.ToSlash(rel); underPrefix(id, prefix) {
+			seen[id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
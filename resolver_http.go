@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var errRemoteNotFound = errors.New("not found at origin")
+
+// downloadPrefix marks copies an HTTPResolver is still downloading.
+const downloadPrefix = ".download-"
+
+// HTTPResolver fetches masters from <base>/<identifier>.<format> into a
+// local directory, so the processors always get a file, removing the least
+// recently used once they add up to more than maxBytes.  Copies are
+// revalidated with If-Modified-Since once they're older than revalidate;
+// misses are remembered for the same length of time so formats we know the
+// origin doesn't have aren't asked for on every request.  Only the
+// maxOriginChecks most recent answers are kept, since clients choose the
+// URLs we ask about.
+type HTTPResolver struct {
+	Client *http.Client
+
+	cacheDir   string
+	revalidate time.Duration
+	urlFor     func(identifier, format string) string
+	sign       func(req *http.Request)
+
+	mu sync.Mutex
+	// checks orders and expires what we last heard from the origin, found
+	// holds what that was.  Each check counts as one byte.
+	checks *lru
+	found  map[string]bool
+	// files orders the copies in cacheDir by use.
+	files *lru
+}
+
+// maxOriginChecks bounds the origin answers an HTTPResolver remembers.
+const maxOriginChecks = 100 * 1000
+
+// NewHTTPResolver keeps copies in cacheDir, picking up any already there.
+// maxBytes of 0 means no limit.
+func NewHTTPResolver(base, cacheDir string, maxBytes int64, revalidate time.Duration) *HTTPResolver {
+	base = strings.TrimRight(base, "/")
+	hr := &HTTPResolver{
+		Client:     &http.Client{Timeout: 5 * time.Minute},
+		cacheDir:   cacheDir,
+		revalidate: revalidate,
+		urlFor: func(identifier, format string) string {
+			return base + "/" + escapePath(identifier, url.PathEscape) + "." + format
+		},
+		checks: newLRU(maxOriginChecks, revalidate),
+		found:  map[string]bool{},
+		files:  newLRU(maxBytes, 0),
+	}
+	hr.indexFiles()
+	return hr
+}
+
+// indexFiles adds the copies already in cacheDir to files.  Their
+// modification times are the origin's, so the order is only a guess at
+// recency, but it gets corrected as they're used.
+func (hr *HTTPResolver) indexFiles() {
+	infos, err := ioutil.ReadDir(hr.cacheDir)
+	if err != nil {
+		return
+	}
+	var entries []*cacheEntry
+	for _, info := range infos {
+		path := filepath.Join(hr.cacheDir, info.Name())
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), downloadPrefix) {
+			// Left by a crash mid-download.
+			os.Remove(path)
+			continue
+		}
+		entries = append(entries, &cacheEntry{key: path, size: info.Size(), written: info.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].written.After(entries[j].written)
+	})
+
+	hr.mu.Lock()
+	for _, entry := range entries {
+		hr.files.addOldest(entry)
+	}
+	evicted := hr.files.evict()
+	hr.mu.Unlock()
+	hr.removeFiles(evicted)
+}
+
+// used marks the copy at local as just used, or adds it at its current size
+// after a download.
+func (hr *HTTPResolver) used(local string, size int64, downloaded bool) {
+	hr.mu.Lock()
+	var evicted []*cacheEntry
+	if entry, _ := hr.files.get(local, "", time.Now()); entry == nil || downloaded {
+		evicted = hr.files.add(&cacheEntry{key: local, size: size, written: time.Now()})
+	}
+	hr.mu.Unlock()
+	hr.removeFiles(evicted)
+}
+
+func (hr *HTTPResolver) removeFiles(entries []*cacheEntry) {
+	for _, entry := range entries {
+		if err := os.Remove(entry.key); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("err removing cached source: %s", err)
+		}
+	}
+}
+
+// Resolve .
+func (hr *HTTPResolver) Resolve(
+	ctx context.Context,
+	identifier string,
+	formats []string,
+) (*Source, error) {
+	for _, format := range formats {
+		src, err := hr.fetch(ctx, identifier, format)
+		if err == errRemoteNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return src, nil
+	}
+	return nil, errors.New(ErrNoSource)
+}
+
+func (hr *HTTPResolver) fetch(
+	ctx context.Context,
+	identifier string,
+	format string,
+) (*Source, error) {
+	rawURL := hr.urlFor(identifier, format)
+	local := filepath.Join(hr.cacheDir, md5str(rawURL)+"."+format)
+
+	hr.mu.Lock()
+	check, stale := hr.checks.get(local, "", time.Now())
+	found := hr.found[local]
+	if stale != nil {
+		delete(hr.found, local)
+	}
+	hr.mu.Unlock()
+	if check != nil {
+		if !found {
+			return nil, errRemoteNotFound
+		}
+		if src, err := localSource(identifier, format, local); err == nil {
+			hr.used(local, src.Size, false)
+			return src, nil
+		}
+	}
+
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	info, statErr := os.Stat(local)
+	if statErr == nil {
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	if hr.sign != nil {
+		hr.sign(req)
+	}
+
+	resp, err := hr.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	downloaded := false
+	switch {
+	case resp.StatusCode == http.StatusNotModified && statErr == nil:
+	case resp.StatusCode == http.StatusOK:
+		if err := hr.download(resp, local); err != nil {
+			return nil, err
+		}
+		downloaded = true
+	case resp.StatusCode == http.StatusNotFound:
+		hr.remember(local, false)
+		return nil, errRemoteNotFound
+	default:
+		return nil, fmt.Errorf("origin returned %s for %s", resp.Status, rawURL)
+	}
+
+	hr.remember(local, true)
+	src, err := localSource(identifier, format, local)
+	if err != nil {
+		return nil, err
+	}
+	hr.used(local, src.Size, downloaded)
+	return src, nil
+}
+
+// download writes resp's body to local atomically, stamping it with the
+// origin's Last-Modified so it can be used for If-Modified-Since later.
+func (hr *HTTPResolver) download(resp *http.Response, local string) error {
+	if err := os.MkdirAll(hr.cacheDir, os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(hr.cacheDir, downloadPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("err downloading %s: %s", resp.Request.URL, err)
+	}
+
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(tmp.Name(), lastModified, lastModified)
+	}
+	if err := os.Chmod(tmp.Name(), os.FileMode(0644)); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), local)
+}
+
+func (hr *HTTPResolver) remember(local string, found bool) {
+	if hr.revalidate <= 0 {
+		// We'd never trust it, and the lru would keep it forever.
+		return
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.found[local] = found
+	evicted := hr.checks.add(&cacheEntry{key: local, size: 1, written: time.Now()})
+	for _, entry := range evicted {
+		delete(hr.found, entry.key)
+	}
+}
+
+func localSource(identifier, format, path string) (*Source, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{
+		Identifier: identifier,
+		Format:     format,
+		Path:       path,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+	}, nil
+}
+
+// escapePath escapes each /-separated segment of p with escape, leaving the
+// slashes alone.
+func escapePath(p string, escape func(string) string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = escape(part)
+	}
+	return strings.Join(parts, "/")
+}
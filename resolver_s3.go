@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config describes a bucket on S3 or anything that speaks its API
+// (MinIO, Ceph, GCS interop, ...).  Requests are path-style,
+// <Endpoint>/<Bucket>/<Prefix><identifier>.<format>, and are only signed if
+// AccessKey is set.
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint" json:"endpoint"`
+	Region    string `yaml:"region" json:"region"`
+	Bucket    string `yaml:"bucket" json:"bucket"`
+	Prefix    string `yaml:"prefix" json:"prefix"`
+	AccessKey string `yaml:"accessKey" json:"accessKey"`
+	SecretKey string `yaml:"secretKey" json:"-"`
+}
+
+// S3Resolver is an HTTPResolver that knows how to address and sign S3
+// requests.
+type S3Resolver struct {
+	*HTTPResolver
+
+	cfg  S3Config
+	base string
+}
+
+// NewS3Resolver .
+func NewS3Resolver(cfg S3Config, cacheDir string, maxBytes int64, revalidate time.Duration) *S3Resolver {
+	base := strings.TrimRight(cfg.Endpoint, "/") + "/" + awsEscape(cfg.Bucket)
+
+	hr := NewHTTPResolver(base, cacheDir, maxBytes, revalidate)
+	hr.urlFor = func(identifier, format string) string {
+		return base + "/" + escapePath(cfg.Prefix+identifier+"."+format, awsEscape)
+	}
+	if cfg.AccessKey != "" {
+		hr.sign = func(req *http.Request) {
+			signV4(req, cfg, time.Now())
+		}
+	}
+	return &S3Resolver{HTTPResolver: hr, cfg: cfg, base: base}
+}
+
+// s3ListResult is the part of a ListObjectsV2 response we use.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through ListObjectsV2 for the masters under prefix.
+func (sr *S3Resolver) List(ctx context.Context, prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {sr.cfg.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequest("GET", sr.base+"?"+canonicalQuery(query), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if sr.sign != nil {
+			sr.sign(req)
+		}
+
+		result, err := sr.listPage(req)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			key := strings.TrimPrefix(object.Key, sr.cfg.Prefix)
+			ext := path.Ext(key)
+			// S3 matches prefixes as strings, so ms-1 brings back ms-12 too.
+			id := strings.TrimSuffix(key, ext)
+			if contains(sourcePreference, strings.TrimPrefix(ext, ".")) && underPrefix(id, prefix) {
+				seen[id] = true
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (sr *S3Resolver) listPage(req *http.Request) (*s3ListResult, error) {
+	resp, err := sr.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("origin returned %s listing %s", resp.Status, req.URL)
+	}
+	var result s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("err decoding listing: %s", err)
+	}
+	return &result, nil
+}
+
+// emptySHA256 is the hex sha256 of an empty body, which is all we ever send.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 adds AWS Signature Version 4 headers to a bodiless request.  See
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signV4(req *http.Request, cfg S3Config, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + emptySHA256 + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(values url.Values) string {
+	var pairs []string
+	for k, vs := range values {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but RFC 3986 unreserved characters,
+// which is stricter than url.PathEscape and what SigV4 expects.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
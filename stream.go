@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ErrRenderAbandoned .
+const ErrRenderAbandoned = "Nobody's waiting for this render any more"
+
+// clientWriter streams a render to the client that asked for it.  The
+// client can go away, or the handler give up on the render, while the
+// render carries on for the cache and anyone else waiting on it, so writes
+// after a failure or after detach are dropped rather than failing the
+// render.
+type clientWriter struct {
+	mu       sync.Mutex
+	w        http.ResponseWriter
+	n        int64
+	failed   bool
+	detached bool
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failed || c.detached {
+		return len(p), nil
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil {
+		c.failed = true
+	}
+	return len(p), nil
+}
+
+// detach stops writes reaching the ResponseWriter, which mustn't be used
+// once the handler has returned.
+func (c *clientWriter) detach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.detached = true
+}
+
+// written is how much of the response has gone out.
+func (c *clientWriter) written() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// cacheTee copies a render into a cache entry on its way to the client.  If
+// the cache fails the client still gets the render.
+type cacheTee struct {
+	client io.Writer
+	cache  CacheWriter
+	err    error
+}
+
+func (t *cacheTee) Write(p []byte) (int, error) {
+	if t.err == nil {
+		_, t.err = t.cache.Write(p)
+	}
+	return t.client.Write(p)
+}
+
+// cutoffWriter passes writes on to w until it's cut off, after which they
+// fail.  It keeps a render that's been given up on, but hasn't noticed yet,
+// from writing to something that's been closed.
+type cutoffWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	cut bool
+}
+
+func (c *cutoffWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cut {
+		return 0, errors.New(ErrRenderAbandoned)
+	}
+	return c.w.Write(p)
+}
+
+func (c *cutoffWriter) cutOff() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cut = true
+}
+
+// renderToCache renders imgReq to client and into the cache under key at
+// the same time.  If the render fails the partial entry is thrown away.
+func (ctx Context) renderToCache(
+	renderCtx context.Context,
+	cfg *Config,
+	src string,
+	imgReq ImageReq,
+	key string,
+	tag CacheTag,
+	client io.Writer,
+) error {
+	cw, err := ctx.cache.Create(key, tag)
+	if err != nil {
+		logrus.Errorf("err writing cache: %s", err)
+		return ctx.render(renderCtx, cfg, src, imgReq, client)
+	}
+
+	tee := &cacheTee{client: client, cache: cw}
+	if err := ctx.render(renderCtx, cfg, src, imgReq, tee); err != nil {
+		cw.Abort()
+		return err
+	}
+	// The render is still good if the cache failed.
+	if tee.err != nil {
+		cw.Abort()
+		logrus.Errorf("err writing cache: %s", tee.err)
+		return nil
+	}
+	if err := cw.Commit(); err != nil {
+		logrus.Errorf("err writing cache: %s", err)
+	}
+	return nil
+}
+
+// render runs imgReq on the worker pool, writing the output to out as it
+// comes, and gives up when renderCtx ends.
+func (ctx Context) render(
+	renderCtx context.Context,
+	cfg *Config,
+	src string,
+	imgReq ImageReq,
+	out io.Writer,
+) error {
+	guarded := &cutoffWriter{w: out}
+	defer guarded.cutOff()
+
+	job := Job{
+		Ctx: renderCtx,
+		Run: func(jobCtx context.Context) error {
+			start := time.Now()
+			err := cfg.processor.Process(jobCtx, src, imgReq, guarded)
+			observeRender(cfg.processor.Name(), start, err)
+			return err
+		},
+		RespChan: make(chan JobResult, 1),
+	}
+	if err := ctx.pool.Submit(job); err != nil {
+		return err
+	}
+
+	// The job may still be sitting in the queue when the deadline passes, so
+	// don't rely on the worker to notice.
+	select {
+	case result := <-job.RespChan:
+		return result.Err
+	case <-renderCtx.Done():
+		return renderCtx.Err()
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// failingProcessor writes half an image and then gives up.
+type failingProcessor struct {
+	GoProcessor
+}
+
+func (failingProcessor) Process(ctx context.Context, src string, imgReq ImageReq, w io.Writer) error {
+	w.Write(make([]byte, 64*1024))
+	return errors.New("disk on fire")
+}
+
+func TestCacheHitsServeContent(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{{Resolver: ResolverConfig{Root: "images"}}})
+	router := newRouter(ctx)
+	path := "/sample2/full/100,/0/default.png"
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got: %d", w.Code)
+	}
+	full := w.Body.Bytes()
+
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Range", "bytes=0-9")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent || string(w.Body.Bytes()) != string(full[:10]) {
+		t.Errorf("expected the first 10 bytes, got: %d %q", w.Code, w.Body.Bytes())
+	}
+	if w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("expected image/png, got: %s", w.Header().Get("Content-Type"))
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("HEAD", path, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(len(full)) {
+		t.Errorf("expected HEAD to give the length, got: %d %q", w.Code, w.Header().Get("Content-Length"))
+	}
+}
+
+func TestFailedRendersAreDiscarded(t *testing.T) {
+	t.Parallel()
+
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+	cache, err := NewDiskCache(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error opening cache: %s", err)
+	}
+
+	ctx := testContext(t, []*Collection{{Resolver: ResolverConfig{Root: "images"}}})
+	ctx.config.Load().processor = failingProcessor{}
+	ctx.cache = cache
+	server := httptest.NewServer(newRouter(ctx))
+	defer server.Close()
+
+	// Some of the image has already gone out by the time the render fails,
+	// so the client should see the connection cut rather than a short
+	// image.
+	resp, err := http.Get(server.URL + "/sample2/full/full/0/default.png")
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("expected the response to be cut short")
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error reading cache dir: %s", err)
+	}
+	if len(entries) != 0 || cache.Len() != 0 {
+		t.Errorf("expected nothing cached, got: %d files, %d entries", len(entries), cache.Len())
+	}
+}
+
+func TestCacheWriterAbort(t *testing.T) {
+	t.Parallel()
+
+	dir := tempCacheDir(t)
+	defer os.RemoveAll(dir)
+	disk, err := NewDiskCache(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error opening cache: %s", err)
+	}
+
+	for _, cache := range []Cache{disk, NewMemoryCache(0, 0), NewTieredCache(NewMemoryCache(0, 0), disk)} {
+		cw, err := cache.Create("a", testTag)
+		if err != nil {
+			t.Fatalf("Unexpected error creating entry: %s", err)
+		}
+		cw.Write([]byte("half a"))
+		if _, ok := cacheGet(cache, "a", testTag); ok {
+			t.Errorf("expected nothing visible before Commit in %T", cache)
+		}
+		cw.Abort()
+		if _, ok := cacheGet(cache, "a", testTag); ok {
+			t.Errorf("expected nothing after Abort in %T", cache)
+		}
+	}
+
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("expected aborted temp files to be removed, got: %d files", len(entries))
+	}
+}
+
+// pausingProcessor waits to be released before writing its render, and
+// says when it's done.
+type pausingProcessor struct {
+	GoProcessor
+	started  chan struct{}
+	release  chan struct{}
+	finished chan struct{}
+	rendered *bytes.Buffer
+}
+
+func (p pausingProcessor) Process(ctx context.Context, src string, imgReq ImageReq, w io.Writer) error {
+	defer close(p.finished)
+	if err := p.GoProcessor.Process(ctx, src, imgReq, p.rendered); err != nil {
+		return err
+	}
+	close(p.started)
+	<-p.release
+	data := p.rendered.Bytes()
+	for i := 0; i < len(data); i += 100 {
+		w.Write(data[i:minInt(i+100, len(data))])
+	}
+	return nil
+}
+
+// erroringWriter calls onError when the handler starts writing an error,
+// before letting it through.
+type erroringWriter struct {
+	*httptest.ResponseRecorder
+	onError func()
+}
+
+func (w *erroringWriter) WriteHeader(status int) {
+	if status != http.StatusOK {
+		w.onError()
+	}
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func TestCancelledLeaderLeavesSharedRender(t *testing.T) {
+	t.Parallel()
+
+	ctx := testContext(t, []*Collection{{Resolver: ResolverConfig{Root: "images"}}})
+	processor := pausingProcessor{
+		started:  make(chan struct{}),
+		release:  make(chan struct{}),
+		finished: make(chan struct{}),
+		rendered: &bytes.Buffer{},
+	}
+	ctx.config.Load().processor = processor
+	router := newRouter(ctx)
+	path := "/sample2/full/100,/0/default.png"
+
+	// The first request starts the render, and goes away before any of it
+	// is written.  The render carries on for the second, and writes all of
+	// it while the first is answering with its error.
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leader := &erroringWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		onError: func() {
+			close(processor.release)
+			<-processor.finished
+		},
+	}
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		router.ServeHTTP(leader, httptest.NewRequest("GET", path, nil).WithContext(leaderCtx))
+	}()
+	<-processor.started
+
+	waiter := httptest.NewRecorder()
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		router.ServeHTTP(waiter, httptest.NewRequest("GET", path, nil))
+	}()
+	for joined := false; !joined; time.Sleep(time.Millisecond) {
+		ctx.renders.mu.Lock()
+		for _, call := range ctx.renders.calls {
+			joined = call.waiters == 2
+		}
+		ctx.renders.mu.Unlock()
+	}
+
+	cancel()
+	<-leaderDone
+	<-waiterDone
+
+	if leader.Code != statusClientClosedRequest || leader.Body.Len() != 0 {
+		t.Errorf("expected the leader to get nothing of the render, got: %d, %d bytes",
+			leader.Code, leader.Body.Len())
+	}
+	if waiter.Code != http.StatusOK || !bytes.Equal(waiter.Body.Bytes(), processor.rendered.Bytes()) {
+		t.Errorf("expected the waiter to get the whole image, got: %d, %d of %d bytes",
+			waiter.Code, waiter.Body.Len(), processor.rendered.Len())
+	}
+}
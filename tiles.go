@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// defaultTileSize is what we advertise when a collection doesn't set one.
+// 512 keeps the request count reasonable without making tiles at the edge
+// of the image expensive.
+const defaultTileSize = 512
+
+// SizeLimits caps the output of a render.  Zero means no limit.
+type SizeLimits struct {
+	MaxWidth  int `yaml:"maxWidth" json:"maxWidth,omitempty"`
+	MaxHeight int `yaml:"maxHeight" json:"maxHeight,omitempty"`
+	MaxArea   int `yaml:"maxArea" json:"maxArea,omitempty"`
+}
+
+// Tile .
+type Tile struct {
+	Width        int   `json:"width"`
+	Height       int   `json:"height,omitempty"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+// InfoSize is an entry in info.json's sizes.
+type InfoSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func (l SizeLimits) validate() error {
+	if l.MaxWidth < 0 || l.MaxHeight < 0 || l.MaxArea < 0 {
+		return errors.New("maxWidth, maxHeight and maxArea can't be negative")
+	}
+	return nil
+}
+
+// Allows reports whether an output of size wh is within the limits.
+func (l SizeLimits) Allows(wh WidthHeight) bool {
+	if l.MaxWidth > 0 && wh.Width > l.MaxWidth {
+		return false
+	}
+	if l.MaxHeight > 0 && wh.Height > l.MaxHeight {
+		return false
+	}
+	if l.MaxArea > 0 && overArea(wh, l.MaxArea) {
+		return false
+	}
+	return true
+}
+
+// overArea reports whether wh covers more than area pixels.  It divides
+// rather than multiplying width by height, which can overflow.
+func overArea(wh WidthHeight, area int) bool {
+	return wh.Width > 0 && wh.Height > 0 && wh.Width > area/wh.Height
+}
+
+// capped is l with MaxArea brought down to maxPixels, the server-wide cap,
+// if that's tighter.
+func (l SizeLimits) capped(maxPixels int) SizeLimits {
+	if maxPixels > 0 && (l.MaxArea == 0 || maxPixels < l.MaxArea) {
+		l.MaxArea = maxPixels
+	}
+	return l
+}
+
+// fit scales region to be as big as the limits allow, keeping its aspect
+// ratio.  Without upscale it's never made bigger than it is.
+func (l SizeLimits) fit(region WidthHeight, upscale bool) WidthHeight {
+	w, h := float64(region.Width), float64(region.Height)
+
+	scale := math.Inf(1)
+	if l.MaxWidth > 0 {
+		scale = math.Min(scale, float64(l.MaxWidth)/w)
+	}
+	if l.MaxHeight > 0 {
+		scale = math.Min(scale, float64(l.MaxHeight)/h)
+	}
+	if l.MaxArea > 0 {
+		scale = math.Min(scale, math.Sqrt(float64(l.MaxArea)/(w*h)))
+	}
+	if math.IsInf(scale, 1) || (!upscale && scale > 1) {
+		scale = 1
+	}
+
+	// Round like scaledSize does, unless that lands a pixel over a limit.
+	out := WidthHeight{
+		Width:  int(round(w * scale)),
+		Height: int(round(h * scale)),
+	}
+	if !l.Allows(out) {
+		out = WidthHeight{
+			Width:  int(math.Floor(w * scale)),
+			Height: int(math.Floor(h * scale)),
+		}
+	}
+	if out.Width < 1 {
+		out.Width = 1
+	}
+	if out.Height < 1 {
+		out.Height = 1
+	}
+	return out
+}
+
+// checkRequested rejects sizes that spell out dimensions over the limits,
+// before we spend any time looking at the image.  Sizes relative to the
+// image are checked once we know its dimensions.
+func (l SizeLimits) checkRequested(size interface{}) error {
+	var wh WidthHeight
+	switch size := size.(type) {
+	case SizeWidth:
+		wh.Width = size.Width
+	case SizeHeight:
+		wh.Height = size.Height
+	case SizeExact:
+		wh = WidthHeight{Width: size.Width, Height: size.Height}
+	default:
+		return nil
+	}
+	if !l.Allows(wh) {
+		return fmt.Errorf("%s: %dx%d", ErrSizeOverLimit, wh.Width, wh.Height)
+	}
+	return nil
+}
+
+// scaleFactors are the powers of two to advertise for tileSize tiles: from
+// 1 up to the first that fits the whole image in a single tile.
+func scaleFactors(stats WidthHeight, tileSize int) []int {
+	longest := stats.Width
+	if stats.Height > longest {
+		longest = stats.Height
+	}
+
+	factors := []int{1}
+	for f := 1; ceilDiv(longest, f) > tileSize; {
+		f *= 2
+		factors = append(factors, f)
+	}
+	return factors
+}
+
+// infoTiles describes the tile grid for an image, shrinking the tiles if
+// they'd break the limits.
+func infoTiles(stats WidthHeight, tileSize int, limits SizeLimits) []Tile {
+	if tileSize <= 0 {
+		tileSize = defaultTileSize
+	}
+	if limits.MaxWidth > 0 && tileSize > limits.MaxWidth {
+		tileSize = limits.MaxWidth
+	}
+	if limits.MaxHeight > 0 && tileSize > limits.MaxHeight {
+		tileSize = limits.MaxHeight
+	}
+	for limits.MaxArea > 0 && tileSize*tileSize > limits.MaxArea && tileSize > 1 {
+		tileSize /= 2
+	}
+
+	return []Tile{{Width: tileSize, ScaleFactors: scaleFactors(stats, tileSize)}}
+}
+
+// infoSizes lists the whole image at each of the scale factors, smallest
+// first, leaving out any the limits forbid.  Viewers use these for
+// thumbnails and for the first, blurry, paint.
+func infoSizes(stats WidthHeight, factors []int, limits SizeLimits) []InfoSize {
+	var sizes []InfoSize
+	for i := len(factors) - 1; i >= 0; i-- {
+		wh := WidthHeight{
+			Width:  ceilDiv(stats.Width, factors[i]),
+			Height: ceilDiv(stats.Height, factors[i]),
+		}
+		if !limits.Allows(wh) {
+			continue
+		}
+		sizes = append(sizes, InfoSize{Width: wh.Width, Height: wh.Height})
+	}
+	return sizes
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
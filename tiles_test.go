@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScaleFactors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		stats    WidthHeight
+		tileSize int
+		expected []int
+	}{
+		{WidthHeight{300, 200}, 512, []int{1}},
+		{WidthHeight{512, 512}, 512, []int{1}},
+		{WidthHeight{513, 100}, 512, []int{1, 2}},
+		{WidthHeight{6000, 4000}, 512, []int{1, 2, 4, 8, 16}},
+		{WidthHeight{4000, 6000}, 256, []int{1, 2, 4, 8, 16, 32}},
+	}
+
+	for _, test := range tests {
+		got := scaleFactors(test.stats, test.tileSize)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("expected %v for %v/%d, got: %v",
+				test.expected, test.stats, test.tileSize, got)
+		}
+	}
+}
+
+func TestInfoTilesAndSizes(t *testing.T) {
+	t.Parallel()
+
+	stats := WidthHeight{3000, 2001}
+
+	tiles := infoTiles(stats, 0, SizeLimits{})
+	expectedTiles := []Tile{{Width: 512, ScaleFactors: []int{1, 2, 4, 8}}}
+	if !reflect.DeepEqual(tiles, expectedTiles) {
+		t.Errorf("expected %v, got: %v", expectedTiles, tiles)
+	}
+
+	sizes := infoSizes(stats, tiles[0].ScaleFactors, SizeLimits{})
+	expectedSizes := []InfoSize{{375, 251}, {750, 501}, {1500, 1001}, {3000, 2001}}
+	if !reflect.DeepEqual(sizes, expectedSizes) {
+		t.Errorf("expected %v, got: %v", expectedSizes, sizes)
+	}
+
+	limits := SizeLimits{MaxWidth: 1000, MaxArea: 100 * 1000}
+	tiles = infoTiles(stats, 512, limits)
+	if tiles[0].Width != 256 {
+		t.Errorf("expected tiles to shrink under maxArea, got: %d", tiles[0].Width)
+	}
+	sizes = infoSizes(stats, []int{1, 2, 4, 8}, limits)
+	if !reflect.DeepEqual(sizes, []InfoSize{{375, 251}}) {
+		t.Errorf("expected only sizes within the limits, got: %v", sizes)
+	}
+}
+
+func TestCheckRequestedSize(t *testing.T) {
+	t.Parallel()
+
+	limits := SizeLimits{MaxWidth: 1000, MaxHeight: 800, MaxArea: 500000}
+	tests := []struct {
+		size string
+		ok   bool
+	}{
+		{"full", true},
+		{"pct:50", true},
+		{"!5000,5000", true},
+		{"1000,", true},
+		{"1001,", false},
+		{",801", false},
+		{"1000,800", false},
+		{"500,500", true},
+	}
+
+	for _, test := range tests {
+		size, err := parseSize(test.size)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %s", test.size, err)
+		}
+		err = limits.checkRequested(size)
+		if (err == nil) != test.ok {
+			t.Errorf("expected ok=%v for %s, got: %v", test.ok, test.size, err)
+		}
+	}
+}
+
+func TestAllowsLargeSizes(t *testing.T) {
+	t.Parallel()
+
+	// Multiplied out, 1<<32 by 1<<32 wraps to 0 in an int.
+	limits := SizeLimits{MaxArea: 100 * 100}
+	for _, wh := range []WidthHeight{
+		{1 << 32, 1 << 32},
+		{math.MaxInt64, 2},
+		{101, 100},
+	} {
+		if limits.Allows(wh) {
+			t.Errorf("expected %v to be over the limit", wh)
+		}
+	}
+	if !limits.Allows(WidthHeight{100, 100}) {
+		t.Errorf("expected 100x100 to be within the limit")
+	}
+}
+
+func TestInfoAdvertisesTiles(t *testing.T) {
+	t.Parallel()
+
+	router := newRouter(testContext(t, []*Collection{{
+		Resolver:   ResolverConfig{Root: "images"},
+		Cache:      CachePolicy{Disabled: true},
+		TileSize:   128,
+		SizeLimits: SizeLimits{MaxWidth: 200},
+	}}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/sample2/info.json", nil))
+	var info struct {
+		Profile []json.RawMessage `json:"profile"`
+		Tiles   []Tile            `json:"tiles"`
+		Sizes   []InfoSize        `json:"sizes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Unexpected error decoding info.json: %s", err)
+	}
+
+	// sample2 is 300x200.
+	if !reflect.DeepEqual(info.Tiles, []Tile{{Width: 128, ScaleFactors: []int{1, 2, 4}}}) {
+		t.Errorf("unexpected tiles: %v", info.Tiles)
+	}
+	if !reflect.DeepEqual(info.Sizes, []InfoSize{{75, 50}, {150, 100}}) {
+		t.Errorf("unexpected sizes: %v", info.Sizes)
+	}
+	var profile Profile
+	if err := json.Unmarshal(info.Profile[1], &profile); err != nil || profile.MaxWidth != 200 {
+		t.Errorf("expected maxWidth in the profile, got: %s", info.Profile[1])
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/sample2/0,0,128,128/128,/0/default.png", http.StatusOK},
+		{"/sample2/full/201,/0/default.png", http.StatusBadRequest},
+		{"/sample2/full/pct:100/0/default.png", http.StatusBadRequest},
+		{"/sample2/full/150,/0/default.png", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("expected %d for %s, got: %d", test.status, test.path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	iiifContext2 = "http://iiif.io/api/image/2/context.json"
+	iiifContext3 = "http://iiif.io/api/image/3/context.json"
+)
+
+// level2Formats come with a level2 profile in 3.0, as does the default
+// quality, so only what's beyond them goes in extraFormats and
+// extraQualities.
+var level2Formats = []string{"jpg", "png"}
+
+var extraQualities3 = []string{"color", "gray", "bitonal"}
+
+// qualities2 and extraFeatures2 are what we support beyond the 2.x level2
+// profile, for the profile description in a 2.x info.json.
+var qualities2 = []string{"default", "color", "gray", "bitonal"}
+
+var extraFeatures2 = []string{
+	"canonicalLinkHeader",
+	"mirroring",
+	"profileLinkHeader",
+	"regionSquare",
+	"rotationArbitrary",
+	"sizeAboveFull",
+}
+
+// extraFeatures3 are the features we support beyond the level2 profile.
+// regionSquare and max are already part of it.
+var extraFeatures3 = []string{
+	"canonicalLinkHeader",
+	"mirroring",
+	"profileLinkHeader",
+	"rotationArbitrary",
+	"sizeUpscaling",
+}
+
+// servedFeatures are the features of a version's info.json that image
+// requests to a collection serving version served can use.  Clients of a
+// 2.x collection can negotiate 3.0's info.json, but image requests are
+// parsed by the collection's version, so a 2.x collection can't take 3.0's
+// ^.  A 3.0 collection won't size beyond the region without it.
+func servedFeatures(features []string, served int) []string {
+	unusable := "sizeUpscaling"
+	if served >= 3 {
+		unusable = "sizeAboveFull"
+	}
+	var usable []string
+	for _, feature := range features {
+		if feature != unusable {
+			usable = append(usable, feature)
+		}
+	}
+	return usable
+}
+
+// ImageInfo3 is the 3.0 shape of an Image Information response.
+type ImageInfo3 struct {
+	Context        string     `json:"@context"`
+	ID             string     `json:"id"`
+	Type           string     `json:"type"`
+	Protocol       string     `json:"protocol"`
+	Profile        string     `json:"profile"`
+	Width          int        `json:"width"`
+	Height         int        `json:"height"`
+	MaxWidth       int        `json:"maxWidth,omitempty"`
+	MaxHeight      int        `json:"maxHeight,omitempty"`
+	MaxArea        int        `json:"maxArea,omitempty"`
+	Tiles          []Tile     `json:"tiles,omitempty"`
+	Sizes          []InfoSize `json:"sizes,omitempty"`
+	ExtraFormats   []string   `json:"extraFormats,omitempty"`
+	ExtraQualities []string   `json:"extraQualities,omitempty"`
+	ExtraFeatures  []string   `json:"extraFeatures,omitempty"`
+}
+
+// negotiateVersion picks the API version for an info.json request: the one
+// named by the profile parameter of an Accept'ed JSON-LD type, e.g.
+//
+//	Accept: application/ld+json;profile="http://iiif.io/api/image/3/context.json"
+//
+// or def if there isn't one.  def is the collection's version, and we never
+// go below it: image requests are parsed by it, and a 2.x client of a 3.0
+// collection would ask for sizes like full that 3.0 removed.
+func negotiateVersion(r *http.Request, def int) int {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || (mediaType != "application/ld+json" && mediaType != "application/json") {
+			continue
+		}
+		switch params["profile"] {
+		case iiifContext3:
+			return 3
+		case iiifContext2:
+			if def > 2 {
+				return def
+			}
+			return 2
+		}
+	}
+	return def
+}
+
+// infoContentType is application/ld+json, with the version's context as its
+// profile, for clients that asked for JSON-LD and application/json for
+// everyone else.
+func infoContentType(r *http.Request, version int) string {
+	if !strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		return "application/json"
+	}
+	context := iiifContext2
+	if version >= 3 {
+		context = iiifContext3
+	}
+	return `application/ld+json;profile="` + context + `"`
+}
+
+// profileLink is the Link header naming the compliance level we serve
+// images at.
+func profileLink(version int) string {
+	if version >= 3 {
+		return `<http://iiif.io/api/image/3/level2.json>;rel="profile"`
+	}
+	return `<http://iiif.io/api/image/2/level2.json>;rel="profile"`
+}
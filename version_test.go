@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		accept   string
+		def      int
+		expected int
+	}{
+		{"", 2, 2},
+		{"", 3, 3},
+		{"application/json", 3, 3},
+		{`application/ld+json;profile="http://iiif.io/api/image/3/context.json"`, 2, 3},
+		{`application/ld+json; profile="http://iiif.io/api/image/2/context.json"`, 2, 2},
+		// Never below the collection's version.
+		{`application/ld+json; profile="http://iiif.io/api/image/2/context.json"`, 3, 3},
+		{`text/html, application/ld+json;profile="http://iiif.io/api/image/3/context.json";q=0.9`, 2, 3},
+		{`application/ld+json;profile="http://example.com/other"`, 2, 2},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/x/info.json", nil)
+		req.Header.Set("Accept", test.accept)
+		if got := negotiateVersion(req, test.def); got != test.expected {
+			t.Errorf("expected %d for %q, got: %d", test.expected, test.accept, got)
+		}
+	}
+}
+
+func TestOutputFor(t *testing.T) {
+	t.Parallel()
+
+	region := WidthHeight{300, 200}
+	limits := SizeLimits{MaxWidth: 600, MaxArea: 150000}
+
+	tests := []struct {
+		size     string
+		version  int
+		expected WidthHeight
+		err      bool
+	}{
+		{"600,", 2, WidthHeight{600, 400}, false},
+		{"600,", 3, WidthHeight{}, true},
+		{"^600,", 3, WidthHeight{600, 400}, false},
+		{"pct:150", 3, WidthHeight{}, true},
+		{"^pct:150", 3, WidthHeight{450, 300}, false},
+		{"!600,600", 2, WidthHeight{600, 400}, false},
+		{"!600,600", 3, WidthHeight{300, 200}, false},
+		{"^!600,600", 3, WidthHeight{600, 400}, false},
+		{"max", 3, WidthHeight{300, 200}, false},
+		// Limited by maxArea: sqrt(150000/60000) = 1.58.
+		{"^max", 3, WidthHeight{474, 316}, false},
+		{"150,", 3, WidthHeight{150, 100}, false},
+	}
+
+	for _, test := range tests {
+		size, err := parseSize(trimCaret(test.size))
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %s", test.size, err)
+		}
+		imgReq := ImageReq{
+			Size:    size,
+			Version: test.version,
+			Upscale: test.size[0] == '^',
+			Limits:  limits,
+		}
+		out, err := imgReq.outputFor(region)
+		if (err != nil) != test.err {
+			t.Errorf("expected error=%v for %s (v%d), got: %v", test.err, test.size, test.version, err)
+			continue
+		}
+		if out != test.expected {
+			t.Errorf("expected %v for %s (v%d), got: %v", test.expected, test.size, test.version, out)
+		}
+	}
+}
+
+func trimCaret(size string) string {
+	if size[0] == '^' {
+		return size[1:]
+	}
+	return size
+}
+
+func TestVersions(t *testing.T) {
+	t.Parallel()
+
+	noCache := CachePolicy{Disabled: true}
+	router := newRouter(testContext(t, []*Collection{
+		{Prefix: "two", Resolver: ResolverConfig{Root: "images"}, Cache: noCache},
+		{Prefix: "three", Resolver: ResolverConfig{Root: "images"}, Cache: noCache, Version: 3},
+	}))
+
+	info := func(path, accept string) (map[string]interface{}, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Unexpected error decoding %s: %s", path, err)
+		}
+		return body, w.Header().Get("Content-Type")
+	}
+
+	v3, _ := info("/three/sample2/info.json", "")
+	if v3["type"] != "ImageService3" || v3["profile"] != "level2" || v3["id"] == nil {
+		t.Errorf("expected a 3.0 info.json, got: %v", v3)
+	}
+	if v3["@context"] != iiifContext3 {
+		t.Errorf("unexpected context: %v", v3["@context"])
+	}
+
+	// A 3.0 collection won't take 2.x's image requests, so it doesn't offer
+	// 2.x's info.json either.
+	v2, _ := info("/three/sample2/info.json", "application/ld+json;profile=\""+iiifContext2+"\"")
+	if v2["@context"] != iiifContext3 {
+		t.Errorf("expected a 3.0 info.json even when 2.x is asked for, got: %v", v2)
+	}
+	full := httptest.NewRecorder()
+	router.ServeHTTP(full, httptest.NewRequest("GET", "/three/sample2/full/full/0/default.png", nil))
+	if v2["@context"] == iiifContext2 && full.Code != http.StatusOK {
+		t.Errorf("a 2.x info.json was served, but full got: %d", full.Code)
+	}
+
+	negotiated, contentType := info("/two/sample2/info.json",
+		"application/ld+json;profile=\""+iiifContext3+"\"")
+	if negotiated["type"] != "ImageService3" {
+		t.Errorf("expected a 3.0 info.json when asked for, got: %v", negotiated)
+	}
+	if contentType != `application/ld+json;profile="`+iiifContext3+`"` {
+		t.Errorf("unexpected content type: %s", contentType)
+	}
+
+	// sample2 is 300x200.
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/two/sample2/full/600,/0/default.png", http.StatusOK},
+		{"/two/sample2/full/max/0/default.png", http.StatusOK},
+		{"/two/sample2/full/^600,/0/default.png", http.StatusBadRequest},
+		{"/three/sample2/full/max/0/default.png", http.StatusOK},
+		{"/two/sample2/full/full/0/default.png", http.StatusOK},
+		{"/three/sample2/full/full/0/default.png", http.StatusBadRequest},
+		{"/three/sample2/full/600,/0/default.png", http.StatusBadRequest},
+		{"/three/sample2/full/^600,/0/default.png", http.StatusOK},
+		{"/three/sample2/full/150,/0/default.png", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("expected %d for %s, got: %d", test.status, test.path, w.Code)
+		}
+	}
+
+	// Whichever info.json a client negotiates, it only lists features the
+	// collection's image requests take.
+	features := func(info map[string]interface{}) []string {
+		list, _ := info["extraFeatures"].([]interface{})
+		if profiles, ok := info["profile"].([]interface{}); ok && len(profiles) > 1 {
+			list, _ = profiles[1].(map[string]interface{})["supports"].([]interface{})
+		}
+		var names []string
+		for _, name := range list {
+			names = append(names, name.(string))
+		}
+		return names
+	}
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	if contains(features(negotiated), "sizeUpscaling") {
+		t.Errorf("expected no sizeUpscaling for a 2.x collection, got: %v", features(negotiated))
+	}
+	if get("/two/sample2/full/^600,/0/default.png") != http.StatusBadRequest {
+		t.Errorf("expected a 2.x collection to reject ^")
+	}
+	if contains(features(v2), "sizeAboveFull") {
+		t.Errorf("expected no sizeAboveFull for a 3.0 collection, got: %v", features(v2))
+	}
+	if get("/three/sample2/full/600,/0/default.png") != http.StatusBadRequest {
+		t.Errorf("expected a 3.0 collection to reject sizes above full without ^")
+	}
+	// Their own info.json still offers them.
+	two, _ := info("/two/sample2/info.json", "")
+	if !contains(features(two), "sizeAboveFull") || !contains(features(v3), "sizeUpscaling") {
+		t.Errorf("expected upscaling in each collection's own info.json, got: %v %v",
+			features(two), features(v3))
+	}
+
+	// Images link to the same profile their info.json names.
+	for path, profile := range map[string]string{
+		"/two/sample2/full/max/0/default.png":   "http://iiif.io/api/image/2/level2.json",
+		"/three/sample2/full/max/0/default.png": "http://iiif.io/api/image/3/level2.json",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		link := `<` + profile + `>;rel="profile"`
+		if !contains(w.Header()["Link"], link) {
+			t.Errorf("expected Link %s for %s, got: %v", link, path, w.Header()["Link"])
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// imageRef is an image as the admin endpoints name it, and the path it's
+// served under.
+type imageRef struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+}
+
+// imagesResult is the response from /admin/images.
+type imagesResult struct {
+	Images []imageRef `json:"images"`
+}
+
+// imagesHandler says where images are served, at /admin/images.  It takes
+// one of
+//
+//	?identifier=scans/ms-12/f1r    that image
+//	?prefix=scans/ms-12/           every image under it
+//
+// with ids as purgeHandler takes them.  Listing a prefix needs resolvers
+// that are Listers.
+func imagesHandler(ctx Context, w http.ResponseWriter, r *http.Request) {
+	cfg := ctx.config.Load()
+	if !authorizeAdmin(cfg, w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	identifier, prefix := query.Get("identifier"), query.Get("prefix")
+	if (identifier == "") == (prefix == "") {
+		writeError(w, r, badRequest("", errors.New(ErrPurgeTarget)))
+		return
+	}
+
+	var images []imageRef
+	if identifier != "" {
+		image, ok := findImage(cfg.collections, identifier)
+		if !ok {
+			writeError(w, r, notFound("identifier", fmt.Sprintf("no collection serves %q", identifier)))
+			return
+		}
+		images = []imageRef{image}
+	} else {
+		var err error
+		if images, err = listImages(r.Context(), cfg.collections, prefix); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(imagesResult{Images: images})
+}
+
+// findImage says where the image id would be served, if any collection
+// could serve it.  It doesn't check that the image exists.
+func findImage(colls *Collections, id string) (imageRef, bool) {
+	_, prefix, identifier, ok := colls.Find(id)
+	if !ok {
+		return imageRef{}, false
+	}
+	return imageRef{ID: id, Path: iiifPath(prefix, url.PathEscape(identifier))}, true
+}
+
+// listImages finds every image whose id is under prefix, in every
+// collection that could have one.
+func listImages(ctx context.Context, colls *Collections, prefix string) ([]imageRef, error) {
+	all := colls.All()
+	collPrefixes := make([]string, 0, len(all))
+	for collPrefix := range all {
+		collPrefixes = append(collPrefixes, collPrefix)
+	}
+	sort.Strings(collPrefixes)
+
+	images := []imageRef{}
+	for _, collPrefix := range collPrefixes {
+		coll := all[collPrefix]
+		within := prefix
+		if collPrefix != "" {
+			switch {
+			case underPrefix(prefix, collPrefix):
+				within = strings.TrimPrefix(strings.TrimPrefix(prefix, collPrefix), "/")
+			case underPrefix(collPrefix, prefix):
+				within = ""
+			default:
+				continue
+			}
+		}
+
+		lister, ok := coll.resolver.(Lister)
+		if !ok {
+			return nil, notImplemented("prefix",
+				fmt.Sprintf("collection %q can't list its images", collPrefix))
+		}
+		ids, err := lister.List(ctx, within)
+		if err != nil {
+			return nil, internalError(fmt.Errorf("err listing %q: %s", collPrefix, err))
+		}
+		for _, id := range ids {
+			ref := imageRef{
+				ID:   strings.TrimPrefix(iiifPath(collPrefix, id), "/"),
+				Path: iiifPath(collPrefix, url.PathEscape(id)),
+			}
+			// Skip images another collection's prefix hides.
+			if found, _, _, _ := colls.Find(ref.ID); found == coll {
+				images = append(images, ref)
+			}
+		}
+	}
+	return images, nil
+}
+
+// warmInfo is the part of either version's info.json that warming needs.
+type warmInfo struct {
+	Context string     `json:"@context"`
+	Width   int        `json:"width"`
+	Height  int        `json:"height"`
+	Tiles   []Tile     `json:"tiles"`
+	Sizes   []InfoSize `json:"sizes"`
+}
+
+// warmPaths are the requests a viewer makes of the image at base, given its
+// info.json: every tile at every scale factor, and every size.  They're
+// built the way OpenSeadragon builds them, so what's warmed is what gets
+// asked for.
+func warmPaths(base string, info warmInfo, format string) []string {
+	v3 := info.Context == iiifContext3
+	size := func(w, h int) string {
+		if v3 {
+			return fmt.Sprintf("%d,%d", w, h)
+		}
+		return fmt.Sprintf("%d,", w)
+	}
+
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(region, size string) {
+		path := fmt.Sprintf("%s/%s/%s/0/default.%s", base, region, size, format)
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, tile := range info.Tiles {
+		tileW, tileH := tile.Width, tile.Height
+		if tileH == 0 {
+			tileH = tileW
+		}
+		for _, scale := range tile.ScaleFactors {
+			regionW, regionH := tileW*scale, tileH*scale
+			for y := 0; y < info.Height; y += regionH {
+				for x := 0; x < info.Width; x += regionW {
+					w := minInt(regionW, info.Width-x)
+					h := minInt(regionH, info.Height-y)
+					region := fmt.Sprintf("%d,%d,%d,%d", x, y, w, h)
+					if w == info.Width && h == info.Height {
+						region = "full"
+					}
+					outW := int(math.Ceil(float64(w) / float64(scale)))
+					outH := int(math.Ceil(float64(h) / float64(scale)))
+					add(region, size(outW, outH))
+				}
+			}
+		}
+	}
+	for _, s := range info.Sizes {
+		add("full", size(s.Width, s.Height))
+	}
+	return paths
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// warmCommand is `iiif-server warm`, which renders the tiles and sizes that
+// info.json advertises into a running server's cache, so the first people
+// to look at newly published images don't wait for them.  Like purge it
+// goes through the server, which renders and caches them exactly as it
+// would for a viewer.  It's turned away with a 503 when the server's queue
+// is full, as a viewer would be, so those requests are tried again after
+// the Retry-After.  With -state, images that were warmed are recorded there
+// and skipped next time, so an interrupted run can pick up where it left
+// off.
+func warmCommand(args []string) error {
+	fs := flag.NewFlagSet("iiif-server warm", flag.ContinueOnError)
+	server := fs.String("server", "http://localhost:8080", "the server to warm")
+	token := fs.String("token", os.Getenv("IIIF_ADMIN_TOKEN"),
+		"token sent with every request, if the server needs one (IIIF_ADMIN_TOKEN)")
+	prefix := fs.Bool("prefix", false, "warm every image under the identifiers given")
+	list := fs.String("list", "", "read identifiers from this file, one per line, or - for stdin")
+	format := fs.String("format", "jpg", "the format to render")
+	concurrency := fs.Int("concurrency", 4, "renders to ask for at once")
+	statePath := fs.String("state", "", "record warmed images here, and skip the ones already in it")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: iiif-server warm [flags] identifier...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	targets := fs.Args()
+	if *list != "" {
+		listed, err := readLines(*list)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, listed...)
+	}
+	if len(targets) == 0 {
+		fs.Usage()
+		return errors.New("warm takes at least one identifier")
+	}
+	if *concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+
+	client := &warmClient{server: strings.TrimRight(*server, "/"), token: *token}
+
+	done := make(map[string]bool)
+	var state *os.File
+	if *statePath != "" {
+		warmed, err := readLines(*statePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, id := range warmed {
+			done[id] = true
+		}
+		state, err = os.OpenFile(*statePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer state.Close()
+	}
+
+	param := "identifier"
+	if *prefix {
+		param = "prefix"
+	}
+	var images []imageRef
+	for _, target := range targets {
+		found, err := client.images(param, target)
+		if err != nil {
+			return err
+		}
+		images = append(images, found...)
+	}
+
+	var skipped, failed int
+	for i, image := range images {
+		if done[image.ID] {
+			skipped++
+			continue
+		}
+		start := time.Now()
+		n, errs := client.warm(image, *format, *concurrency)
+		if errs > 0 {
+			failed++
+			fmt.Printf("[%d/%d] %s: %d of %d renders failed\n", i+1, len(images), image.ID, errs, n)
+			continue
+		}
+		fmt.Printf("[%d/%d] %s: %d renders in %s\n",
+			i+1, len(images), image.ID, n, time.Since(start).Round(time.Millisecond))
+		if state != nil {
+			if _, err := fmt.Fprintln(state, image.ID); err != nil {
+				return err
+			}
+		}
+		done[image.ID] = true
+	}
+
+	if skipped > 0 {
+		fmt.Printf("skipped %d images already warmed\n", skipped)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed to warm", failed, len(images))
+	}
+	return nil
+}
+
+// warmClient makes warmCommand's requests.
+type warmClient struct {
+	server string
+	token  string
+}
+
+// warmRetries is how many times a request the server turned away with a
+// 503, because its queue was full, is tried again.  It waits as long as
+// the server's Retry-After asks, up to maxRetryAfter.
+const (
+	warmRetries   = 5
+	maxRetryAfter = 30 * time.Second
+)
+
+func (c *warmClient) get(path string, out io.Writer) error {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, c.server+path, nil)
+		if err != nil {
+			return err
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable && attempt < warmRetries {
+			resp.Body.Close()
+			time.Sleep(retryAfter(resp.Header.Get("Retry-After")))
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+			return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		_, err = io.Copy(out, resp.Body)
+		return err
+	}
+}
+
+// retryAfter is how long a Retry-After header in seconds asks us to wait,
+// capped at maxRetryAfter, or a second if it doesn't say.
+func retryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds < 0 {
+		return time.Second
+	}
+	if wait := time.Duration(seconds) * time.Second; wait < maxRetryAfter {
+		return wait
+	}
+	return maxRetryAfter
+}
+
+func (c *warmClient) getJSON(path string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := c.get(path, &buf); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf.Bytes(), v); err != nil {
+		return fmt.Errorf("err decoding %s: %s", path, err)
+	}
+	return nil
+}
+
+// images asks the server where the images named by target are.
+func (c *warmClient) images(param, target string) ([]imageRef, error) {
+	var result imagesResult
+	err := c.getJSON("/admin/images?"+url.Values{param: {target}}.Encode(), &result)
+	return result.Images, err
+}
+
+// warm requests every tile and size of image, returning how many there
+// were and how many failed.
+func (c *warmClient) warm(image imageRef, format string, concurrency int) (int, int) {
+	var info warmInfo
+	if err := c.getJSON(image.Path+"/info.json", &info); err != nil {
+		logrus.Warnf("%s: %s", image.ID, err)
+		return 0, 1
+	}
+	paths := warmPaths(image.Path, info, format)
+
+	var failed int32
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range queue {
+				if err := c.get(path, ioutil.Discard); err != nil {
+					atomic.AddInt32(&failed, 1)
+					logrus.Warnf("%s: %s", path, err)
+				}
+			}
+		}()
+	}
+	for _, path := range paths {
+		queue <- path
+	}
+	close(queue)
+	wg.Wait()
+	return len(paths), int(failed)
+}
+
+// readLines reads the non-blank lines of path, or of stdin if it's "-".
+func readLines(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
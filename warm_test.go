@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmPaths(t *testing.T) {
+	t.Parallel()
+
+	info := warmInfo{
+		Context: iiifContext2,
+		Width:   1000,
+		Height:  600,
+		Tiles:   []Tile{{Width: 256, ScaleFactors: []int{1, 2, 4}}},
+		Sizes:   []InfoSize{{Width: 250, Height: 150}, {Width: 500, Height: 300}},
+	}
+	paths := warmPaths("/scans/f1r", info, "jpg")
+	// 4x3 tiles, then 2x2, then the whole image at 1/4, which is also the
+	// first size.
+	if len(paths) != 12+4+1+1 {
+		t.Errorf("expected 18 paths, got: %d %v", len(paths), paths)
+	}
+	for _, expected := range []string{
+		"/scans/f1r/0,0,256,256/256,/0/default.jpg",
+		"/scans/f1r/768,512,232,88/232,/0/default.jpg",
+		"/scans/f1r/512,512,488,88/244,/0/default.jpg",
+		"/scans/f1r/full/250,/0/default.jpg",
+		"/scans/f1r/full/500,/0/default.jpg",
+	} {
+		if !contains(paths, expected) {
+			t.Errorf("expected %s, got: %v", expected, paths)
+		}
+	}
+
+	info.Context = iiifContext3
+	paths = warmPaths("/scans/f1r", info, "jpg")
+	if !contains(paths, "/scans/f1r/768,512,232,88/232,88/0/default.jpg") {
+		t.Errorf("expected 3.0 sizes to have both dimensions, got: %v", paths)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "iiif-warm")
+	if err != nil {
+		t.Fatalf("Unexpected error making temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	data, err := ioutil.ReadFile("images/sample2.png")
+	if err != nil {
+		t.Fatalf("Unexpected error reading sample: %s", err)
+	}
+	for _, dir := range []string{"ms-12", "ms-1"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"ms-12/f1r.png", "ms-12/f1v.png", "ms-1/f1r.png", "other.png"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := testContext(t, []*Collection{
+		{Resolver: ResolverConfig{Root: "images"}},
+		{Prefix: "scans", Resolver: ResolverConfig{Root: root}, TileSize: 64},
+	})
+	var requests int32
+	router := newRouter(ctx)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	get := func(path string) string {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return strings.TrimSpace(string(body))
+	}
+	for path, expected := range map[string]string{
+		"/admin/images?identifier=scans/ms-12/f1r": `{"images":[{"id":"scans/ms-12/f1r","path":"/scans/ms-12%2Ff1r"}]}`,
+		"/admin/images?prefix=scans/ms-12": `{"images":[` +
+			`{"id":"scans/ms-12/f1r","path":"/scans/ms-12%2Ff1r"},` +
+			`{"id":"scans/ms-12/f1v","path":"/scans/ms-12%2Ff1v"}]}`,
+		// Prefixes match whole segments, as purges do.
+		"/admin/images?prefix=scans/ms-1": `{"images":[{"id":"scans/ms-1/f1r","path":"/scans/ms-1%2Ff1r"}]}`,
+		"/admin/images?prefix=scans/ms":   `{"images":[]}`,
+		"/admin/images?prefix=sample2":    `{"images":[{"id":"sample2","path":"/sample2"}]}`,
+	} {
+		if body := get(path); body != expected {
+			t.Errorf("expected %s for %s, got: %s", expected, path, body)
+		}
+	}
+
+	state := filepath.Join(root, "warm.state")
+	warm := []string{"-server", server.URL, "-format", "png", "-state", state, "-prefix", "scans/ms-12/"}
+	if err := warmCommand(warm); err != nil {
+		t.Fatalf("Unexpected error warming: %s", err)
+	}
+	cache := ctx.cache.(*MemoryCache)
+	warmed := cache.Len()
+	if warmed == 0 {
+		t.Fatalf("expected renders to be cached")
+	}
+	if raw, _ := ioutil.ReadFile(state); string(raw) != "scans/ms-12/f1r\nscans/ms-12/f1v\n" {
+		t.Errorf("expected both images recorded, got: %q", raw)
+	}
+
+	// What a viewer asks for is already there.
+	before := cache.Len()
+	get("/scans/ms-12%2Ff1r/0,0,64,64/64,/0/default.png")
+	if cache.Len() != before {
+		t.Errorf("expected a warmed tile to be a cache hit")
+	}
+
+	// Running it again only asks which images there are.
+	atomic.StoreInt32(&requests, 0)
+	if err := warmCommand(warm); err != nil {
+		t.Fatalf("Unexpected error warming again: %s", err)
+	}
+	if requests != 1 || cache.Len() != warmed {
+		t.Errorf("expected everything to be skipped, got: %d requests", requests)
+	}
+
+	err = warmCommand([]string{"-server", server.URL, "scans/missing"})
+	if err == nil || !strings.Contains(err.Error(), "1 of 1 images failed") {
+		t.Errorf("expected a missing image to fail, got: %v", err)
+	}
+}
+
+func TestWarmClientRetries(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/busy" || n < 3 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, ErrQueueFull.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+	client := &warmClient{server: server.URL}
+
+	var out bytes.Buffer
+	if err := client.get("/tile", &out); err != nil || out.String() != "tile" {
+		t.Errorf("expected the tile after the queue cleared, got: %q %v", out.String(), err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 2 retries, got: %d requests", requests)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	err := client.get("/busy", ioutil.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "503") {
+		t.Errorf("expected a 503 once the retries ran out, got: %v", err)
+	}
+	if requests != warmRetries+1 {
+		t.Errorf("expected %d tries, got: %d", warmRetries+1, requests)
+	}
+
+	for header, expected := range map[string]time.Duration{
+		"":      time.Second,
+		"2":     2 * time.Second,
+		"-1":    time.Second,
+		"86400": maxRetryAfter,
+	} {
+		if wait := retryAfter(header); wait != expected {
+			t.Errorf("expected to wait %s for Retry-After %q, got: %s", expected, header, wait)
+		}
+	}
+}